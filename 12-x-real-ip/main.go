@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"sync/atomic"
 )
 
@@ -46,10 +47,12 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	index := int(atomic.AddUint32(&rrlbIndex, 1))
 	r.URL.Host = upstreams[index%len(upstreams)]
 
+	// resolve real ip before append current hop to xff
+	r.Header.Set("X-Real-IP", realIPFromRequest(r))
+
 	// xf* headers
 	r.Header.Set("X-Forwarded-Proto", protoFromRequest(r))
-	r.Header.Set("X-Forwarded-For", remoteHostFromRequest(r))
-	r.Header.Set("X-Real-IP", realIPFromRequest(r))
+	r.Header.Set("X-Forwarded-For", forwardedForFromRequest(r))
 
 	// forward request to upstream
 	resp, err := tr.RoundTrip(r)
@@ -75,23 +78,120 @@ func protoFromRequest(r *http.Request) string {
 }
 
 func remoteHostFromRequest(r *http.Request) string {
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return host
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// forwardedForFromRequest appends remote host to X-Forwarded-For chain
+func forwardedForFromRequest(r *http.Request) string {
+	xff := remoteHostFromRequest(r)
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		xff = strings.Join(prior, ", ") + ", " + xff
+	}
+	return xff
 }
 
-var _, trustCIDR, _ = net.ParseCIDR("192.168.0.2/32")
+// trustCIDRs are proxies allowed to tell us the client ip
+var trustCIDRs = parseCIDRs(
+	"127.0.0.0/8",
+	"::1/128",
+	"192.168.0.2/32",
+)
+
+// realIPSource is the header to resolve client ip from,
+// one of X-Forwarded-For, X-Real-IP, Forwarded, CF-Connecting-IP
+var realIPSource = "X-Forwarded-For"
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var ns []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+func isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses ip from remote addr or header value,
+// ex. 192.0.2.1, 192.0.2.1:80, 2001:db8::1, [2001:db8::1]:80, fe80::1%eth0
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	// zone only meaningful on local host
+	if i := strings.LastIndex(s, "%"); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
 
 func realIPFromRequest(r *http.Request) string {
-	realIP := r.Header.Get("X-Real-IP")
-	remoteIP := remoteHostFromRequest(r)
+	remoteIP := parseIP(r.RemoteAddr)
+	if !isTrusted(remoteIP) {
+		return remoteHostFromRequest(r)
+	}
 
-	if realIP == "" {
-		return remoteIP
+	var chain []string
+	switch realIPSource {
+	case "X-Forwarded-For":
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+	case "Forwarded":
+		chain = forwardedFor(r.Header.Values("Forwarded"))
+	default:
+		chain = []string{r.Header.Get(realIPSource)}
 	}
 
-	if trustCIDR.Contains(net.ParseIP(remoteIP)) {
-		return realIP
+	// walk from right to left, first untrusted hop is the client
+	ip := remoteIP
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseIP(chain[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(ip) {
+			break
+		}
 	}
+	return ip.String()
+}
 
-	return remoteIP
+// forwardedFor returns for= parameters from Forwarded headers
+func forwardedFor(values []string) []string {
+	var fs []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				fs = append(fs, strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+	return fs
 }
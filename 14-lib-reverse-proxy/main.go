@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"sort"
+	"strings"
 	"sync/atomic"
 )
 
@@ -29,6 +35,9 @@ func startUpstream(port int) {
 		fmt.Fprintf(w, "XFF: %s\n", r.Header.Get("X-Forwarded-For"))
 		fmt.Fprintf(w, "XFP: %s\n", r.Header.Get("X-Forwarded-Proto"))
 		fmt.Fprintf(w, "Real IP: %s\n", r.Header.Get("X-Real-IP"))
+		fmt.Fprintf(w, "XFH: %s\n", r.Header.Get("X-Forwarded-Host"))
+		fmt.Fprintf(w, "XFPort: %s\n", r.Header.Get("X-Forwarded-Port"))
+		fmt.Fprintf(w, "Forwarded: %s\n", r.Header.Get("Forwarded"))
 	}
 
 	http.ListenAndServe(fmt.Sprintf(":%d", port), http.HandlerFunc(h))
@@ -55,11 +64,28 @@ func createReverseProxy() http.Handler {
 		},
 	}
 
+	route := func(config forwardedConfig) http.Handler {
+		return chain(
+			xfHeaders(config),
+			removeRemoteAddr,
+		)(rev)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", route(forwardedConfig{
+		Styles: styleXForwarded | styleXForwardedHost | styleForwarded,
+		By:     "_proxy1",
+	}))
+
+	// legacy upstream only understand x-forwarded-*
+	mux.Handle("/legacy/", route(forwardedConfig{
+		Styles: styleXForwarded,
+	}))
+
+	// resolve real ip before xfHeaders append current hop to xff
 	return chain(
-		xfHeaders,
 		realIPHeader,
-		removeRemoteAddr,
-	)(rev)
+	)(mux)
 }
 
 func chain(hs ...func(h http.Handler) http.Handler) func(h http.Handler) http.Handler {
@@ -71,13 +97,76 @@ func chain(hs ...func(h http.Handler) http.Handler) func(h http.Handler) http.Ha
 	}
 }
 
-func xfHeaders(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Header.Set("X-Forwarded-Proto", protoFromRequest(r))
-		r.Header.Set("X-Forwarded-For", remoteHostFromRequest(r))
+// forwardedStyle selects which forwarding headers send to upstream
+type forwardedStyle int
 
-		h.ServeHTTP(w, r)
-	})
+const (
+	styleXForwarded     forwardedStyle = 1 << iota // X-Forwarded-For, X-Forwarded-Proto
+	styleXForwardedHost                            // X-Forwarded-Host, X-Forwarded-Port
+	styleForwarded                                 // RFC 7239 Forwarded
+)
+
+type forwardedConfig struct {
+	Styles       forwardedStyle
+	By           string // by= node identifier, ex. 192.0.2.1, _proxy1; empty to omit
+	ObfuscateFor bool   // send obfuscated identifier instead of client ip in for=
+}
+
+func xfHeaders(config forwardedConfig) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// only keep host and forwarded chain from trusted hop
+			trusted := isTrusted(parseIP(r.RemoteAddr))
+			proto := protoFromRequest(r)
+
+			if config.Styles&styleXForwarded != 0 {
+				r.Header.Set("X-Forwarded-Proto", proto)
+				r.Header.Set("X-Forwarded-For", forwardedForFromRequest(r))
+			} else {
+				r.Header.Del("X-Forwarded-Proto")
+				r.Header.Del("X-Forwarded-For")
+			}
+
+			if config.Styles&styleXForwardedHost != 0 {
+				if !trusted || r.Header.Get("X-Forwarded-Host") == "" {
+					r.Header.Set("X-Forwarded-Host", r.Host)
+				}
+				if !trusted || r.Header.Get("X-Forwarded-Port") == "" {
+					r.Header.Set("X-Forwarded-Port", portFromRequest(r))
+				}
+			} else {
+				r.Header.Del("X-Forwarded-Host")
+				r.Header.Del("X-Forwarded-Port")
+			}
+
+			if config.Styles&styleForwarded != 0 {
+				var elems []forwardedElement
+				if trusted {
+					elems = parseForwarded(r.Header.Values("Forwarded"))
+				}
+
+				remoteIP := parseIP(r.RemoteAddr)
+				elem := forwardedElement{
+					"for":   forwardedNode(remoteIP),
+					"proto": proto,
+					"host":  r.Host,
+				}
+				if config.ObfuscateFor {
+					elem["for"] = obfuscatedNode(remoteIP)
+				}
+				if config.By != "" {
+					elem["by"] = config.By
+				}
+				elems = append(elems, elem)
+
+				r.Header.Set("Forwarded", formatForwarded(elems))
+			} else {
+				r.Header.Del("Forwarded")
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
 }
 
 func realIPHeader(h http.Handler) http.Handler {
@@ -103,24 +192,273 @@ func protoFromRequest(r *http.Request) string {
 	return "https"
 }
 
+func portFromRequest(r *http.Request) string {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return port
+	}
+	if r.TLS == nil {
+		return "80"
+	}
+	return "443"
+}
+
 func remoteHostFromRequest(r *http.Request) string {
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return host
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// forwardedForFromRequest appends remote host to X-Forwarded-For chain
+func forwardedForFromRequest(r *http.Request) string {
+	xff := remoteHostFromRequest(r)
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		xff = strings.Join(prior, ", ") + ", " + xff
+	}
+	return xff
 }
 
-var _, trustCIDR, _ = net.ParseCIDR("192.168.0.2/32")
+// trustCIDRs are proxies allowed to tell us the client ip
+var trustCIDRs = parseCIDRs(
+	"127.0.0.0/8",
+	"::1/128",
+	"192.168.0.2/32",
+)
+
+// realIPSource is the header to resolve client ip from,
+// one of X-Forwarded-For, X-Real-IP, Forwarded, CF-Connecting-IP
+var realIPSource = "X-Forwarded-For"
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var ns []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+func isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses ip from remote addr or header value,
+// ex. 192.0.2.1, 192.0.2.1:80, 2001:db8::1, [2001:db8::1]:80, fe80::1%eth0
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	// zone only meaningful on local host
+	if i := strings.LastIndex(s, "%"); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
 
 func realIPFromRequest(r *http.Request) string {
-	realIP := r.Header.Get("X-Real-IP")
-	remoteIP := remoteHostFromRequest(r)
+	remoteIP := parseIP(r.RemoteAddr)
+	if !isTrusted(remoteIP) {
+		return remoteHostFromRequest(r)
+	}
 
-	if realIP == "" {
-		return remoteIP
+	var chain []string
+	switch realIPSource {
+	case "X-Forwarded-For":
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+	case "Forwarded":
+		chain = forwardedFor(r.Header.Values("Forwarded"))
+	default:
+		chain = []string{r.Header.Get(realIPSource)}
 	}
 
-	if trustCIDR.Contains(net.ParseIP(remoteIP)) {
-		return realIP
+	// walk from right to left, first untrusted hop is the client
+	ip := remoteIP
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseIP(chain[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// forwardedFor returns for= parameters from Forwarded headers
+func forwardedFor(values []string) []string {
+	var fs []string
+	for _, elem := range parseForwarded(values) {
+		fs = append(fs, elem["for"])
 	}
+	return fs
+}
 
-	return remoteIP
+// forwardedElement is a forwarded-element from RFC 7239, keys are lower case
+type forwardedElement map[string]string
+
+// keys returns parameter names, well-known parameters first
+func (elem forwardedElement) keys() []string {
+	var ks, ext []string
+	for _, k := range []string{"for", "by", "proto", "host"} {
+		if _, ok := elem[k]; ok {
+			ks = append(ks, k)
+		}
+	}
+	for k := range elem {
+		switch k {
+		case "for", "by", "proto", "host":
+		default:
+			ext = append(ext, k)
+		}
+	}
+	sort.Strings(ext)
+	return append(ks, ext...)
+}
+
+// parseForwarded parses Forwarded headers into elements, from left to right
+func parseForwarded(values []string) []forwardedElement {
+	var elems []forwardedElement
+	for _, v := range values {
+		elem := forwardedElement{}
+		for {
+			v = strings.TrimLeft(v, " \t")
+			i := strings.IndexAny(v, "=;,")
+			if i < 0 {
+				break
+			}
+			key := strings.ToLower(strings.TrimSpace(v[:i]))
+			v = v[i:]
+			if v[0] == '=' {
+				var value string
+				value, v = parseForwardedValue(v[1:])
+				if key != "" {
+					elem[key] = value
+				}
+				v = strings.TrimLeft(v, " \t")
+			}
+			if v == "" {
+				break
+			}
+			if v[0] == ',' && len(elem) > 0 {
+				elems = append(elems, elem)
+				elem = forwardedElement{}
+			}
+			v = v[1:]
+		}
+		if len(elem) > 0 {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// parseForwardedValue parses token or quoted-string, returns value and the rest
+func parseForwardedValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, ";, \t")
+		if i < 0 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), ""
+}
+
+func formatForwarded(elems []forwardedElement) string {
+	var parts []string
+	for _, elem := range elems {
+		var pairs []string
+		for _, k := range elem.keys() {
+			pairs = append(pairs, k+"="+quoteForwarded(elem[k]))
+		}
+		parts = append(parts, strings.Join(pairs, ";"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// quoteForwarded quotes value if it is not a token
+func quoteForwarded(v string) string {
+	for i := 0; i < len(v); i++ {
+		if !isTokenChar(v[i]) {
+			return `"` + forwardedEscaper.Replace(v) + `"`
+		}
+	}
+	if v == "" {
+		return `""`
+	}
+	return v
+}
+
+var forwardedEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// forwardedNode formats ip as node name, ipv6 must be in brackets
+func forwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+// obfuscateKey makes obfuscated node stable per process but not reversible
+var obfuscateKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+func obfuscatedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	m := hmac.New(sha256.New, obfuscateKey)
+	m.Write(ip.To16())
+	return "_" + hex.EncodeToString(m.Sum(nil)[:8])
 }
@@ -1,79 +1,723 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
+var upstreams = []string{"127.0.0.1:9000", "127.0.0.1:9001"}
+
 func main() {
-	h := logMiddleware(http.HandlerFunc(handler))
-	http.ListenAndServe(":8080", h)
+	// only first upstream is running, requests to the second one are retried
+	go startUpstream(9000)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", logMiddleware(LogConfig{
+		Format: formatCombined,
+	})(http.HandlerFunc(handler)))
+	mux.Handle("/api/", logMiddleware(LogConfig{
+		Format: formatJSON,
+		Fields: []string{
+			"timestamp", "request_id", "status", "method", "uri", "remote_ip", "duration", "ttfb",
+			"bytes_in", "bytes_out", "upstream_addr", "upstream_status", "upstream_connect", "upstream_latency",
+			"retries", "user_agent",
+		},
+		RequestHeaders:  []string{"Accept"},
+		ResponseHeaders: []string{"Content-Type"},
+	})(createReverseProxy()))
+	mux.Handle("/debug/", logMiddleware(LogConfig{
+		Format: formatLogfmt,
+		Fields: []string{"timestamp", "request_id", "status", "method", "uri", "tls_version", "tls_cipher", "sni", "referer"},
+	})(http.HandlerFunc(handler)))
+	mux.Handle("/short/", logMiddleware(LogConfig{
+		Format: formatTemplate(`{{.RemoteIP}} {{.Method}} {{.URI}} {{.Status}} {{.Duration}}`),
+	})(http.HandlerFunc(handler)))
+
+	// logUncompressed sits inside compression to log both sizes
+	mux.Handle("/gzip/", logMiddleware(LogConfig{
+		Format: formatLogfmt,
+		Fields: []string{"timestamp", "status", "method", "uri", "duration", "ttfb", "bytes_out", "bytes_out_raw"},
+	})(gzipMiddleware(logUncompressed(http.HandlerFunc(textHandler)))))
+
+	http.ListenAndServe(":8080", mux)
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello"))
 }
 
-func logMiddleware(h http.Handler) http.Handler {
+func textHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	for i := 0; i < 100; i++ {
+		w.Write([]byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit.\n"))
+	}
+}
+
+// gzipMiddleware is a minimal compressor for logging example,
+// see 16-compress for a complete one
+func gzipMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := &gzipResponseWriter{
+			ResponseWriter: w,
+			zw:             gzip.NewWriter(w),
+		}
+		defer gw.zw.Close()
+
+		h.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	zw *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	w.Header().Del("Content-Length")
+	return w.zw.Write(p)
+}
+
+func startUpstream(port int) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Upstream %d\n", port)
+		fmt.Fprintf(w, "Request ID: %s\n", r.Header.Get(requestIDHeader))
+	}
+
+	http.ListenAndServe(fmt.Sprintf(":%d", port), http.HandlerFunc(h))
+}
+
+func createReverseProxy() http.Handler {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// upstream host is picked by transport on each try
+			r.URL.Scheme = "http"
+		},
+		Transport: &upstreamTransport{
+			RoundTripper: &http.Transport{
+				MaxIdleConnsPerHost: 10,
+			},
+			maxRetries: 2,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println(err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+}
+
+// upstreamTransport round robins upstreams, retries safe requests,
+// and records upstream into log entry
+type upstreamTransport struct {
+	http.RoundTripper
+	index      uint32
+	maxRetries int
+}
+
+func (t *upstreamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	entry := logEntryFromContext(r.Context())
+	for retry := 0; ; retry++ {
+		index := int(atomic.AddUint32(&t.index, 1))
+
+		// RoundTrip must not modify r, each try gets its own copy
+		var timing upstreamTiming
+		ctx := r.Context()
+		if entry != nil {
+			ctx = httptrace.WithClientTrace(ctx, timing.trace())
+		}
+		req := r.Clone(ctx)
+		req.URL.Host = upstreams[index%len(upstreams)]
+
+		start := time.Now()
+		resp, err := t.RoundTripper.RoundTrip(req)
+		if entry != nil {
+			entry.UpstreamAddr = req.URL.Host
+			entry.UpstreamLatency = time.Since(start)
+			entry.UpstreamConnect, entry.UpstreamTLS = timing.get()
+			entry.Retries = retry
+			if resp != nil {
+				entry.UpstreamStatus = resp.StatusCode
+			}
+		}
+
+		canRetry := isSafeMethod(r.Method) && (r.Body == nil || r.Body == http.NoBody)
+		if err == nil || !canRetry || retry >= t.maxRetries {
+			return resp, err
+		}
+	}
+}
+
+// upstreamTiming records connect and tls handshake time of a new upstream connection,
+// trace callbacks may run in dial goroutine after RoundTrip returned
+type upstreamTiming struct {
+	mu           sync.Mutex
+	connectStart time.Time
+	connect      time.Duration
+	tlsStart     time.Time
+	tls          time.Duration
+}
+
+func (t *upstreamTiming) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			t.connect = time.Since(t.connectStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.tls = time.Since(t.tlsStart)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// get returns zero for reused connection
+func (t *upstreamTiming) get() (connect, tls time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.connect, t.tls
+}
+
+// isSafeMethod reports whether request can be sent again without side effect
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+const requestIDHeader = "X-Request-Id"
+
+// LogConfig configs logMiddleware, use different config per route
+// to log in different formats
+type LogConfig struct {
+	Format          logFormat // default formatJSON
+	Fields          []string  // fields for json and logfmt, see logFields
+	RequestHeaders  []string  // log these request headers as req.<name>
+	ResponseHeaders []string  // log these response headers as resp.<name>
+	Output          io.Writer // default os.Stdout
+}
+
+var defaultLogFields = []string{
+	"timestamp", "status", "method", "uri", "host", "remote_ip", "duration", "bytes_in", "bytes_out",
+}
+
+// logEntry is filled while serving the request,
+// handlers down the chain add to it through logEntryFromContext
+type logEntry struct {
+	Time            time.Time
+	RequestID       string
+	Status          int
+	Method          string
+	URI             string
+	Proto           string
+	Host            string
+	RemoteIP        string
+	User            string
+	Duration        time.Duration
+	TTFB            time.Duration // until first response byte, header or body
+	BytesIn         int64         // request body bytes read by handler
+	BytesOut        int64         // response body bytes sent, after compression
+	BytesOutRaw     int64         // response body bytes before compression, see logUncompressed
+	Hijacked        bool
+	UserAgent       string
+	Referer         string
+	TLSVersion      string
+	TLSCipher       string
+	SNI             string
+	UpstreamAddr    string
+	UpstreamStatus  int
+	UpstreamLatency time.Duration // until upstream response header
+	UpstreamConnect time.Duration // zero for reused connection
+	UpstreamTLS     time.Duration // zero for reused or plain connection
+	Retries         int
+	RequestHeaders  http.Header // only selected headers
+	ResponseHeaders http.Header // only selected headers
+}
+
+var logFields = map[string]func(e *logEntry) interface{}{
+	"timestamp":        func(e *logEntry) interface{} { return e.Time.Format(time.RFC3339) },
+	"request_id":       func(e *logEntry) interface{} { return e.RequestID },
+	"status":           func(e *logEntry) interface{} { return e.Status },
+	"method":           func(e *logEntry) interface{} { return e.Method },
+	"uri":              func(e *logEntry) interface{} { return e.URI },
+	"proto":            func(e *logEntry) interface{} { return e.Proto },
+	"host":             func(e *logEntry) interface{} { return e.Host },
+	"remote_ip":        func(e *logEntry) interface{} { return e.RemoteIP },
+	"user":             func(e *logEntry) interface{} { return e.User },
+	"duration":         func(e *logEntry) interface{} { return milliseconds(e.Duration) },
+	"ttfb":             func(e *logEntry) interface{} { return milliseconds(e.TTFB) },
+	"bytes_in":         func(e *logEntry) interface{} { return e.BytesIn },
+	"bytes_out":        func(e *logEntry) interface{} { return e.BytesOut },
+	"bytes_out_raw":    func(e *logEntry) interface{} { return e.BytesOutRaw },
+	"hijacked":         func(e *logEntry) interface{} { return e.Hijacked },
+	"user_agent":       func(e *logEntry) interface{} { return e.UserAgent },
+	"referer":          func(e *logEntry) interface{} { return e.Referer },
+	"tls_version":      func(e *logEntry) interface{} { return e.TLSVersion },
+	"tls_cipher":       func(e *logEntry) interface{} { return e.TLSCipher },
+	"sni":              func(e *logEntry) interface{} { return e.SNI },
+	"upstream_addr":    func(e *logEntry) interface{} { return e.UpstreamAddr },
+	"upstream_status":  func(e *logEntry) interface{} { return e.UpstreamStatus },
+	"upstream_latency": func(e *logEntry) interface{} { return milliseconds(e.UpstreamLatency) },
+	"upstream_connect": func(e *logEntry) interface{} { return milliseconds(e.UpstreamConnect) },
+	"upstream_tls":     func(e *logEntry) interface{} { return milliseconds(e.UpstreamTLS) },
+	"retries":          func(e *logEntry) interface{} { return e.Retries },
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type contextKey int
+
+const logEntryKey contextKey = iota
+
+func logEntryFromContext(ctx context.Context) *logEntry {
+	e, _ := ctx.Value(logEntryKey).(*logEntry)
+	return e
+}
+
+func logMiddleware(config LogConfig) func(http.Handler) http.Handler {
+	if config.Format == nil {
+		config.Format = formatJSON
+	}
+	if config.Fields == nil {
+		config.Fields = defaultLogFields
+	}
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+	for _, f := range config.Fields {
+		if _, ok := logFields[f]; !ok {
+			panic("log: unknown field " + f)
+		}
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timestamp := time.Now()
+
+			requestID := r.Header.Get(requestIDHeader)
+			if requestID == "" {
+				requestID = newRequestID()
+				r.Header.Set(requestIDHeader, requestID)
+			}
+			w.Header().Set(requestIDHeader, requestID)
+
+			entry := &logEntry{
+				Time:        timestamp,
+				RequestID:   requestID,
+				BytesOutRaw: -1,
+			}
+			r = r.WithContext(context.WithValue(r.Context(), logEntryKey, entry))
+
+			// ContentLength is -1 for chunked body, count what is actually read
+			body := &logRequestBody{ReadCloser: r.Body}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = body
+			}
+
+			nw := &logResponseWriter{
+				ResponseWriter: w,
+			}
+			defer func() {
+				entry.Duration = time.Since(timestamp)
+				entry.BytesIn = atomic.LoadInt64(&body.n)
+				entry.fill(r, nw, &config)
+
+				var buf bytes.Buffer
+				if err := config.Format(&buf, entry, &config); err != nil {
+					log.Println("log:", err)
+					return
+				}
+				config.Output.Write(buf.Bytes())
+			}()
+
+			h.ServeHTTP(nw, r)
+		})
+	}
+}
+
+func (e *logEntry) fill(r *http.Request, w *logResponseWriter, config *LogConfig) {
+	e.Status = w.statusCode
+	e.Hijacked = w.hijacked
+	if e.Status == 0 {
+		// net/http sends 200 when handler writes nothing
+		e.Status = http.StatusOK
+		if w.hijacked {
+			e.Status = http.StatusSwitchingProtocols
+		}
+	}
+	e.TTFB = e.Duration
+	if !w.firstByte.IsZero() {
+		e.TTFB = w.firstByte.Sub(e.Time)
+	}
+	e.Method = r.Method
+	e.URI = r.RequestURI
+	e.Proto = r.Proto
+	e.Host = r.Host
+	e.RemoteIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	e.User, _, _ = r.BasicAuth()
+	e.BytesOut = atomic.LoadInt64(&w.sentBytes)
+	if e.BytesOutRaw < 0 {
+		e.BytesOutRaw = e.BytesOut
+	}
+	e.UserAgent = r.UserAgent()
+	e.Referer = r.Referer()
+	if r.TLS != nil {
+		e.TLSVersion = tlsVersionName(r.TLS.Version)
+		e.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+		e.SNI = r.TLS.ServerName
+	}
+
+	if len(config.RequestHeaders) > 0 {
+		e.RequestHeaders = make(http.Header)
+		for _, k := range config.RequestHeaders {
+			e.RequestHeaders.Set(k, r.Header.Get(k))
+		}
+	}
+	if len(config.ResponseHeaders) > 0 {
+		e.ResponseHeaders = make(http.Header)
+		for _, k := range config.ResponseHeaders {
+			e.ResponseHeaders.Set(k, w.Header().Get(k))
+		}
+	}
+}
+
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// fields returns selected fields then selected headers in config order
+func (e *logEntry) fields(config *LogConfig) []logField {
+	fs := make([]logField, 0, len(config.Fields)+len(config.RequestHeaders)+len(config.ResponseHeaders))
+	for _, f := range config.Fields {
+		fs = append(fs, logField{f, logFields[f](e)})
+	}
+	for _, k := range config.RequestHeaders {
+		fs = append(fs, logField{"req." + strings.ToLower(k), e.RequestHeaders.Get(k)})
+	}
+	for _, k := range config.ResponseHeaders {
+		fs = append(fs, logField{"resp." + strings.ToLower(k), e.ResponseHeaders.Get(k)})
+	}
+	return fs
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+func tlsVersionName(v uint16) string {
+	if s, ok := tlsVersions[v]; ok {
+		return s
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// logFormat writes one log line of entry
+type logFormat func(w io.Writer, e *logEntry, config *LogConfig) error
+
+// formatJSON writes fields as json object, keeping fields order
+func formatJSON(w io.Writer, e *logEntry, config *LogConfig) error {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range e.fields(config) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.Key)
+		v, err := json.Marshal(f.Value)
+		if err != nil {
+			return err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// formatLogfmt writes fields as key=value pairs
+func formatLogfmt(w io.Writer, e *logEntry, config *LogConfig) error {
+	var buf bytes.Buffer
+	for i, f := range e.fields(config) {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		switch v := f.Value.(type) {
+		case string:
+			if v == "" || strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < ' ' }) >= 0 {
+				v = strconv.Quote(v)
+			}
+			buf.WriteString(v)
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			fmt.Fprint(&buf, v)
+		}
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// formatCombined writes Apache combined log format, fields are ignored
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+func formatCombined(w io.Writer, e *logEntry, config *LogConfig) error {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	size := "-"
+	if e.BytesOut > 0 {
+		size = strconv.FormatInt(e.BytesOut, 10)
+	}
+	_, err := fmt.Fprintf(w, "%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		dash(e.RemoteIP),
+		dash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escapeCombined(e.URI), e.Proto,
+		e.Status,
+		size,
+		dash(escapeCombined(e.Referer)),
+		dash(escapeCombined(e.UserAgent)),
+	)
+	return err
+}
+
+func escapeCombined(s string) string {
+	s = strconv.Quote(s)
+	return s[1 : len(s)-1]
+}
+
+// formatTemplate writes entry using text/template, a newline is appended
+//
+//	formatTemplate(`{{.RemoteIP}} {{.Method}} {{.URI}} {{.Status}} {{.RequestHeaders.Get "Accept"}}`)
+func formatTemplate(text string) logFormat {
+	t := template.Must(template.New("log").Parse(text))
+	return func(w io.Writer, e *logEntry, config *LogConfig) error {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, e); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+}
+
+// logUncompressed records body bytes written by h before compression,
+// put it between compress middleware and handler
+func logUncompressed(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		timestamp := time.Now()
+		entry := logEntryFromContext(r.Context())
+		if entry == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
 		nw := &logResponseWriter{
 			ResponseWriter: w,
 		}
 		defer func() {
-			diff := time.Since(timestamp)
-			remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
-			json.NewEncoder(os.Stdout).Encode(struct {
-				Timestamp string `json:"timestamp"`
-				Status    int    `json:"status"`
-				Method    string `json:"method"`
-				URI       string `json:"uri"`
-				Host      string `json:"host"`
-				RemoteIP  string `json:"remote_ip"`
-				Duration  string `json:"duration"`
-				BytesIn   int64  `json:"bytes_in"`
-				BytesOut  int64  `json:"bytes_out"`
-			}{
-				timestamp.Format(time.RFC3339),
-				nw.statusCode,
-				r.Method,
-				r.RequestURI,
-				r.Host,
-				remoteIP,
-				diff.String(),
-				r.ContentLength,
-				nw.sentBytes,
-			})
+			entry.BytesOutRaw = atomic.LoadInt64(&nw.sentBytes)
 		}()
 
 		h.ServeHTTP(nw, r)
 	})
 }
 
+type logRequestBody struct {
+	io.ReadCloser
+	n int64 // read by transport goroutine when proxied
+}
+
+func (b *logRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
 type logResponseWriter struct {
 	http.ResponseWriter
 
 	wroteHeader bool
 	statusCode  int
-	sentBytes   int64
+	sentBytes   int64 // hijacked connection may be written after handler returned
+	firstByte   time.Time
+	hijacked    bool
 }
 
 func (w *logResponseWriter) WriteHeader(status int) {
 	if w.wroteHeader {
 		return
 	}
+
+	// informational, the final header is still to come
+	if status >= 100 && status <= 199 && status != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.wroteHeader = true
 	w.statusCode = status
 	w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *logResponseWriter) markFirstByte() {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+}
+
 func (w *logResponseWriter) Write(p []byte) (int, error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
+	w.markFirstByte()
 	n, err := w.ResponseWriter.Write(p)
-	w.sentBytes += int64(n)
+	atomic.AddInt64(&w.sentBytes, int64(n))
 	return n, err
 }
+
+func (w *logResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.markFirstByte()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack counts bytes written to the raw connection as sent bytes
+func (w *logResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.markFirstByte()
+	cc := &logConn{Conn: conn, w: w}
+	return cc, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(cc)), nil
+}
+
+func (w *logResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.markFirstByte()
+	var (
+		n   int64
+		err error
+	)
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{w.ResponseWriter}, r)
+	}
+	atomic.AddInt64(&w.sentBytes, n)
+	return n, err
+}
+
+type logConn struct {
+	net.Conn
+	w *logResponseWriter
+}
+
+func (c *logConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.w.sentBytes, int64(n))
+	return n, err
+}
+
+func (w *logResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writerOnly hides ReadFrom from io.Copy
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func discardLog(h http.Handler) http.Handler {
+	return logMiddleware(LogConfig{Output: ioutil.Discard})(h)
+}
+
+// logStacks nest logResponseWriter, as logMiddleware and logUncompressed do,
+// inner writer must pass every optional interface through the outer one
+var logStacks = []struct {
+	name  string
+	stack func(http.Handler) http.Handler
+}{
+	{"log", discardLog},
+	{"log over log", func(h http.Handler) http.Handler { return discardLog(discardLog(h)) }},
+	{"log over uncompressed", func(h http.Handler) http.Handler { return discardLog(logUncompressed(h)) }},
+}
+
+func serveStack(t *testing.T, stack func(http.Handler) http.Handler, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(stack(h))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, url string) *http.Response {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestLogFlush(t *testing.T) {
+	flushers := map[string]func(w http.ResponseWriter) error{
+		"Flusher": func(w http.ResponseWriter) error {
+			w.(http.Flusher).Flush()
+			return nil
+		},
+		"ResponseController": func(w http.ResponseWriter) error {
+			return http.NewResponseController(w).Flush()
+		},
+	}
+
+	for _, s := range logStacks {
+		for name, flush := range flushers {
+			t.Run(s.name+"/"+name, func(t *testing.T) {
+				release := make(chan struct{})
+				defer close(release)
+
+				srv := serveStack(t, s.stack, func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, "first\n")
+					if err := flush(w); err != nil {
+						t.Errorf("flush: %v", err)
+					}
+					// line must reach client while handler is blocked
+					<-release
+					io.WriteString(w, "second\n")
+				})
+
+				resp := get(t, srv.URL)
+				line, err := bufio.NewReader(resp.Body).ReadString('\n')
+				if err != nil || line != "first\n" {
+					t.Fatalf("read flushed line = %q, %v", line, err)
+				}
+			})
+		}
+	}
+}
+
+func TestLogHijack(t *testing.T) {
+	hijackers := map[string]func(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error){
+		"Hijacker": func(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+			return w.(http.Hijacker).Hijack()
+		},
+		"ResponseController": func(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+			return http.NewResponseController(w).Hijack()
+		},
+	}
+
+	for _, s := range logStacks {
+		for name, hijack := range hijackers {
+			t.Run(s.name+"/"+name, func(t *testing.T) {
+				srv := serveStack(t, s.stack, func(w http.ResponseWriter, r *http.Request) {
+					conn, rw, err := hijack(w)
+					if err != nil {
+						t.Errorf("hijack: %v", err)
+						return
+					}
+					defer conn.Close()
+					rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 3\r\nConnection: close\r\n\r\nraw")
+					rw.Flush()
+				})
+
+				resp := get(t, srv.URL)
+				b, err := ioutil.ReadAll(resp.Body)
+				if err != nil || string(b) != "raw" {
+					t.Fatalf("body = %q, %v, want bytes written to the conn", b, err)
+				}
+			})
+		}
+	}
+}
+
+func TestLogReadFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	for _, s := range logStacks {
+		t.Run(s.name, func(t *testing.T) {
+			srv := serveStack(t, s.stack, func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := w.(io.ReaderFrom); !ok {
+					t.Errorf("%T does not implement io.ReaderFrom", w)
+				}
+				io.Copy(w, bytes.NewReader(data))
+			})
+
+			resp := get(t, srv.URL)
+			b, _ := ioutil.ReadAll(resp.Body)
+			if !bytes.Equal(b, data) {
+				t.Fatalf("body %d bytes, want %d bytes", len(b), len(data))
+			}
+		})
+	}
+}
+
+func TestLogResponseControllerDeadlines(t *testing.T) {
+	for _, s := range logStacks {
+		t.Run(s.name, func(t *testing.T) {
+			srv := serveStack(t, s.stack, func(w http.ResponseWriter, r *http.Request) {
+				// deadlines exist only on the server's writer, under logResponseWriter
+				rc := http.NewResponseController(w)
+				if err := rc.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+					t.Errorf("SetWriteDeadline: %v", err)
+				}
+				if err := rc.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+					t.Errorf("SetReadDeadline: %v", err)
+				}
+				io.WriteString(w, "ok")
+			})
+
+			resp := get(t, srv.URL)
+			b, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(b) != "ok" {
+				t.Fatalf("got %d %q", resp.StatusCode, b)
+			}
+		})
+	}
+}
+
+// chanWriter passes each log line to test
+type chanWriter chan []byte
+
+func (c chanWriter) Write(p []byte) (int, error) {
+	c <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func serveLogged(t *testing.T, fields []string, h http.Handler) (*httptest.Server, chanWriter) {
+	t.Helper()
+	lines := make(chanWriter, 1)
+	srv := httptest.NewServer(logMiddleware(LogConfig{Fields: fields, Output: lines})(h))
+	t.Cleanup(srv.Close)
+	return srv, lines
+}
+
+func readEntry(t *testing.T, lines chanWriter) map[string]interface{} {
+	t.Helper()
+	select {
+	case line := <-lines:
+		var m map[string]interface{}
+		if err := json.Unmarshal(line, &m); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no log line")
+	}
+	return nil
+}
+
+func TestLogBytesInChunked(t *testing.T) {
+	body := strings.Repeat("chunk", 1000)
+	tests := []struct {
+		name string
+		read func(r io.Reader)
+		want int
+	}{
+		{"full", func(r io.Reader) { io.Copy(ioutil.Discard, r) }, len(body)},
+		{"partial", func(r io.Reader) { io.ReadFull(r, make([]byte, 10)) }, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, lines := serveLogged(t, []string{"status", "bytes_in"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.ContentLength != -1 {
+					t.Errorf("ContentLength = %d, want chunked body", r.ContentLength)
+				}
+				tt.read(r.Body)
+			}))
+
+			// reader of unknown length is sent chunked
+			req, _ := http.NewRequest(http.MethodPost, srv.URL, ioutil.NopCloser(strings.NewReader(body)))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			e := readEntry(t, lines)
+			if got := e["bytes_in"]; got != float64(tt.want) {
+				t.Fatalf("bytes_in = %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogHijacked(t *testing.T) {
+	const raw = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\nhello"
+
+	srv, lines := serveLogged(t, []string{"status", "bytes_out", "hijacked"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString(raw)
+		rw.Flush()
+	}))
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+	b, _ := ioutil.ReadAll(conn)
+	if string(b) != raw {
+		t.Fatalf("read %q, want %q", b, raw)
+	}
+
+	e := readEntry(t, lines)
+	if e["status"] != float64(http.StatusSwitchingProtocols) {
+		t.Errorf("status = %v, want 101", e["status"])
+	}
+	if e["hijacked"] != true {
+		t.Errorf("hijacked = %v, want true", e["hijacked"])
+	}
+	if e["bytes_out"] != float64(len(raw)) {
+		t.Errorf("bytes_out = %v, want %d", e["bytes_out"], len(raw))
+	}
+}
+
+func TestLogStatusWithoutWriteHeader(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"write":    func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") },
+		"no write": func(w http.ResponseWriter, r *http.Request) {},
+	}
+
+	for name, h := range handlers {
+		t.Run(name, func(t *testing.T) {
+			srv, lines := serveLogged(t, []string{"status"}, h)
+			get(t, srv.URL)
+			if e := readEntry(t, lines); e["status"] != float64(http.StatusOK) {
+				t.Fatalf("status = %v, want 200", e["status"])
+			}
+		})
+	}
+}
+
+func TestLogUncompressed(t *testing.T) {
+	srv, lines := serveLogged(t, []string{"bytes_out", "bytes_out_raw"}, gzipMiddleware(logUncompressed(http.HandlerFunc(textHandler))))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	// set by hand, so transport does not decode it
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(zr)
+
+	e := readEntry(t, lines)
+	if e["bytes_out_raw"] != float64(len(body)) {
+		t.Errorf("bytes_out_raw = %v, want %d", e["bytes_out_raw"], len(body))
+	}
+	if out, _ := e["bytes_out"].(float64); out <= 0 || out >= float64(len(body)) {
+		t.Errorf("bytes_out = %v, want compressed size below %d", e["bytes_out"], len(body))
+	}
+}
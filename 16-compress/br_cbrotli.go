@@ -0,0 +1,45 @@
+//go:build cgo && cbrotli
+// +build cgo,cbrotli
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/google/brotli/go/cbrotli"
+)
+
+// brWriter uses the brotli C library, only with cbrotli build tag.
+//
+// cbrotli frees the encoder state on Close and can not reset it,
+// so each stream still gets a new state, but Reset frees an unfinished one
+// instead of leaking it
+type brWriter struct {
+	quality int
+	dst     io.Writer
+	*cbrotli.Writer
+}
+
+func (w *brWriter) Reset(p io.Writer) {
+	if w.Writer != nil {
+		// no-op if already closed, otherwise finish into nothing to free C state
+		w.dst = ioutil.Discard
+		w.Writer.Close()
+	}
+	w.dst = p
+	w.Writer = cbrotli.NewWriter(brDst{w}, cbrotli.WriterOptions{Quality: w.quality})
+}
+
+// brDst lets Reset switch destination of the C encoder output
+type brDst struct {
+	w *brWriter
+}
+
+func (d brDst) Write(p []byte) (int, error) {
+	return d.w.dst.Write(p)
+}
+
+func newBrReader(r io.Reader) io.ReadCloser {
+	return cbrotli.NewReader(r)
+}
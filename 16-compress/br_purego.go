@@ -0,0 +1,30 @@
+//go:build !cgo || !cbrotli
+// +build !cgo !cbrotli
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+)
+
+// brWriter uses pure Go brotli, encoder is reused across streams by Reset,
+// build with cbrotli tag to use the brotli C library instead
+type brWriter struct {
+	quality int
+	*brotli.Writer
+}
+
+func (w *brWriter) Reset(p io.Writer) {
+	if w.Writer == nil {
+		w.Writer = brotli.NewWriterLevel(p, w.quality)
+		return
+	}
+	w.Writer.Reset(p)
+}
+
+func newBrReader(r io.Reader) io.ReadCloser {
+	return ioutil.NopCloser(brotli.NewReader(r))
+}
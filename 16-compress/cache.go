@@ -0,0 +1,72 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CompressCache is an in-memory LRU of compressed bodies,
+// keyed by request host and uri, encoding and upstream etag
+type CompressCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	maxEntry int
+	size     int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type compressCacheEntry struct {
+	key  string
+	body []byte
+}
+
+// NewCompressCache creates cache holding up to maxBytes of compressed bodies,
+// a single body larger than 1/8 of maxBytes is not cached
+func NewCompressCache(maxBytes int) *CompressCache {
+	return &CompressCache{
+		maxBytes: maxBytes,
+		maxEntry: maxBytes / 8,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *CompressCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*compressCacheEntry).body, true
+}
+
+func (c *CompressCache) Add(key string, body []byte) {
+	if len(body) > c.maxEntry {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*compressCacheEntry)
+		c.size += len(body) - len(entry.body)
+		entry.body = body
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[key] = c.ll.PushFront(&compressCacheEntry{key: key, body: body})
+		c.size += len(body)
+	}
+
+	for c.size > c.maxBytes {
+		e := c.ll.Back()
+		entry := e.Value.(*compressCacheEntry)
+		c.ll.Remove(e)
+		delete(c.items, entry.key)
+		c.size -= len(entry.body)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type DecompressConfig struct {
+	MaxSize  int64 // max decoded body size, 0 for no limit
+	MaxRatio int64 // max decoded to encoded size ratio, 0 for no limit
+}
+
+// decompressRatioSlack is decoded size allowed before checking ratio,
+// tiny bodies can legitimately have huge ratios
+const decompressRatioSlack = 64 << 10
+
+// decompressMaxWindow limits zstd decoder memory
+const decompressMaxWindow = 8 << 20
+
+var errDecompressLimit = errors.New("decompress: decoded body exceeds limit")
+
+var decoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+	"br": func(r io.Reader) (io.ReadCloser, error) {
+		return newBrReader(r), nil
+	},
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(decompressMaxWindow),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+const decodersAcceptEncoding = "gzip, deflate, br, zstd"
+
+// Decompress decodes request body with Content-Encoding before it reaches h,
+// unsupported encodings are rejected with 415, bodies over the limits with 413
+func Decompress(config DecompressConfig) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var codings []string
+			for _, v := range r.Header.Values("Content-Encoding") {
+				for _, c := range strings.Split(v, ",") {
+					c = strings.ToLower(strings.TrimSpace(c))
+					if c == "" || c == "identity" {
+						continue
+					}
+					if c == "x-gzip" {
+						c = "gzip"
+					}
+					if _, ok := decoders[c]; !ok {
+						w.Header().Set("Accept-Encoding", decodersAcceptEncoding)
+						http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+						return
+					}
+					codings = append(codings, c)
+				}
+			}
+			if len(codings) == 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			body := &decompressBody{
+				src:    r.Body,
+				config: config,
+			}
+			body.in.r = r.Body
+
+			// codings are listed in the order they were applied
+			var rd io.Reader = &body.in
+			for i := len(codings) - 1; i >= 0; i-- {
+				d, err := decoders[codings[i]](rd)
+				if err != nil {
+					body.Close()
+					http.Error(w, "Bad Request", http.StatusBadRequest)
+					return
+				}
+				body.decoders = append(body.decoders, d)
+				rd = d
+			}
+			body.rd = rd
+
+			r = r.Clone(r.Context())
+			r.Body = body
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+
+			// handler sees only a read error, e.g. proxy would answer 502
+			dw := &decompressWriter{ResponseWriter: w, body: body}
+			h.ServeHTTP(dw, r)
+			if !dw.wroteHeader && body.overLimit() {
+				dw.reject()
+			}
+		})
+	}
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type decompressBody struct {
+	src      io.ReadCloser
+	in       countReader
+	rd       io.Reader
+	decoders []io.ReadCloser
+	config   DecompressConfig
+	out      int64
+	err      error
+	limit    int32 // set when limits were hit, read by response writer
+}
+
+func (b *decompressBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.rd.Read(p)
+	b.out += int64(n)
+	if b.config.MaxSize > 0 && b.out > b.config.MaxSize ||
+		b.config.MaxRatio > 0 && b.out > decompressRatioSlack && b.out > b.config.MaxRatio*b.in.n {
+		b.err = errDecompressLimit
+		atomic.StoreInt32(&b.limit, 1)
+		return 0, b.err
+	}
+	return n, err
+}
+
+func (b *decompressBody) overLimit() bool {
+	return atomic.LoadInt32(&b.limit) == 1
+}
+
+func (b *decompressBody) Close() error {
+	for i := len(b.decoders) - 1; i >= 0; i-- {
+		b.decoders[i].Close()
+	}
+	return b.src.Close()
+}
+
+// decompressWriter responds 413 instead of handler's response
+// once the decoded body went over the limits
+type decompressWriter struct {
+	http.ResponseWriter
+	body        *decompressBody
+	wroteHeader bool
+	rejected    bool // handler's response is dropped
+}
+
+func (w *decompressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if w.body.overLimit() {
+		w.reject()
+		return
+	}
+	if code >= 200 {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *decompressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rejected {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *decompressWriter) reject() {
+	w.wroteHeader = true
+	w.rejected = true
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Connection", "close")
+	http.Error(w.ResponseWriter, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+}
+
+func (w *decompressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rejected {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *decompressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.wroteHeader = true
+	return conn, rw, nil
+}
+
+func (w *decompressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
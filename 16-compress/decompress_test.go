@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// randomBytes does not compress, ratio stays near 1
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func postEncoded(t *testing.T, url, encoding string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", encoding)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, b
+}
+
+// echoHandler answers with the decoded body, 500 on read error
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func TestDecompressDecodesBody(t *testing.T) {
+	data := randomBytes(16 << 10)
+	srv := serveStack(t, Decompress(DecompressConfig{MaxSize: 1 << 20, MaxRatio: 100}), func(w http.ResponseWriter, r *http.Request) {
+		if ce := r.Header.Get("Content-Encoding"); ce != "" {
+			t.Errorf("handler sees Content-Encoding %q", ce)
+		}
+		echoHandler(w, r)
+	})
+
+	resp, b := postEncoded(t, srv.URL, "gzip", gzipBytes(data))
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(b, data) {
+		t.Fatalf("got %d, %d bytes, want 200, %d bytes", resp.StatusCode, len(b), len(data))
+	}
+}
+
+func TestDecompressMaxSize(t *testing.T) {
+	config := DecompressConfig{MaxSize: 256 << 10}
+	data := make([]byte, 512<<10)
+
+	backend := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	handlers := map[string]http.HandlerFunc{
+		"read error": echoHandler,
+		"ignore error": func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			io.WriteString(w, "ok")
+		},
+		"no write": func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+		},
+		// proxy would answer 502 for the failed upload
+		"proxy": httputil.NewSingleHostReverseProxy(backendURL).ServeHTTP,
+	}
+
+	for name, h := range handlers {
+		t.Run(name, func(t *testing.T) {
+			srv := serveStack(t, Decompress(config), h)
+
+			resp, _ := postEncoded(t, srv.URL, "gzip", gzipBytes(data))
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want 413", resp.StatusCode)
+			}
+		})
+	}
+
+	t.Run("within limit", func(t *testing.T) {
+		srv := serveStack(t, Decompress(config), echoHandler)
+		small := make([]byte, 128<<10)
+		resp, b := postEncoded(t, srv.URL, "gzip", gzipBytes(small))
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(b, small) {
+			t.Fatalf("got %d, %d bytes, want 200, %d bytes", resp.StatusCode, len(b), len(small))
+		}
+	})
+}
+
+func TestDecompressMaxRatio(t *testing.T) {
+	srv := serveStack(t, Decompress(DecompressConfig{MaxRatio: 100}), echoHandler)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantStatus int
+	}{
+		{"bomb", make([]byte, 4<<20), http.StatusRequestEntityTooLarge},
+		// tiny bodies may have huge ratio, allowed up to decompressRatioSlack
+		{"under slack", make([]byte, decompressRatioSlack/2), http.StatusOK},
+		{"normal ratio", randomBytes(256 << 10), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, b := postEncoded(t, srv.URL, "gzip", gzipBytes(tt.data))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && !bytes.Equal(b, tt.data) {
+				t.Fatalf("got %d bytes, want %d bytes", len(b), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestDecompressUnsupportedEncoding(t *testing.T) {
+	srv := serveStack(t, Decompress(DecompressConfig{}), func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called for unsupported encoding")
+	})
+
+	resp, _ := postEncoded(t, srv.URL, "compress", []byte("body"))
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want 415", resp.StatusCode)
+	}
+	if ae := resp.Header.Get("Accept-Encoding"); ae != decodersAcceptEncoding {
+		t.Fatalf("Accept-Encoding = %q, want %q", ae, decodersAcceptEncoding)
+	}
+}
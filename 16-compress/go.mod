@@ -2,4 +2,8 @@ module 16-compress
 
 go 1.14
 
-require github.com/google/brotli v1.0.7
+require (
+	github.com/andybalholm/brotli v1.0.5
+	github.com/google/brotli v1.0.7
+	github.com/klauspost/compress v1.15.15
+)
@@ -1,23 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"compress/zlib"
 	"io"
 	"io/ioutil"
 	"mime"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/google/brotli/go/cbrotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 func main() {
+	cache := NewCompressCache(64 << 20)
+	configs := []CompressConfig{Br(), Zstd(), Gzip(), Deflate()}
+	for i := range configs {
+		configs[i].Cache = cache
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static", Precompressed("static")))
+	mux.HandleFunc("/", handler)
+
 	h := chain(
-		Compress(Gzip()),
-		Compress(Br()),
-	)(http.HandlerFunc(handler))
+		Compress(configs...),
+		Decompress(DecompressConfig{MaxSize: 10 << 20, MaxRatio: 100}),
+	)(mux)
 	http.ListenAndServe(":8080", h)
 }
 
@@ -37,21 +51,18 @@ func chain(hs ...func(h http.Handler) http.Handler) func(h http.Handler) http.Ha
 
 type CompressConfig struct {
 	New       func() Compressor
-	Encoding  string // http Accept-Encoding, Content-Encoding value
-	Vary      bool   // add Vary: Accept-Encoding
-	Types     string // only compress for given types, * for all types
-	MinLength int    // skip if Content-Length less than given value
+	Best      func() Compressor // max quality, used for bodies of known length that fit in Cache
+	Encoding  string            // http Accept-Encoding, Content-Encoding value
+	Vary      bool              // add Vary: Accept-Encoding
+	Types     string            // only compress for given types, * for all types
+	MinLength int               // skip if Content-Length less than given value
+	Cache     *CompressCache    // cache compressed bodies by strong ETag, nil to disable
 }
 
 func Gzip() CompressConfig {
 	return CompressConfig{
-		New: func() Compressor {
-			g, err := gzip.NewWriterLevel(ioutil.Discard, gzip.DefaultCompression)
-			if err != nil {
-				panic(err)
-			}
-			return g
-		},
+		New:       newGzip(gzip.DefaultCompression),
+		Best:      newGzip(gzip.BestCompression),
 		Encoding:  "gzip",
 		Vary:      defaultCompressVary,
 		Types:     defaultCompressTypes,
@@ -61,9 +72,8 @@ func Gzip() CompressConfig {
 
 func Br() CompressConfig {
 	return CompressConfig{
-		New: func() Compressor {
-			return &brWriter{quality: 4}
-		},
+		New:       newBr(4),
+		Best:      newBr(11),
 		Encoding:  "br",
 		Vary:      defaultCompressVary,
 		Types:     defaultCompressTypes,
@@ -71,45 +81,132 @@ func Br() CompressConfig {
 	}
 }
 
-type brWriter struct {
-	quality int
-	*cbrotli.Writer
+func Deflate() CompressConfig {
+	return DeflateLevel(zlib.DefaultCompression)
+}
+
+// DeflateLevel uses zlib format as http deflate, window size is fixed at 32KB
+func DeflateLevel(level int) CompressConfig {
+	return CompressConfig{
+		New:       newZlib(level),
+		Best:      newZlib(zlib.BestCompression),
+		Encoding:  "deflate",
+		Vary:      defaultCompressVary,
+		Types:     defaultCompressTypes,
+		MinLength: defaultCompressMinLength,
+	}
+}
+
+func Zstd() CompressConfig {
+	return ZstdLevel(zstd.SpeedDefault, defaultZstdWindowSize)
+}
+
+// ZstdLevel creates zstd config, windowSize must be power of 2 between 1KB and 512MB,
+// client must buffer whole window to decode, so keep it small
+func ZstdLevel(level zstd.EncoderLevel, windowSize int) CompressConfig {
+	return CompressConfig{
+		New:       newZstd(level, windowSize),
+		Best:      newZstd(zstd.SpeedBestCompression, windowSize),
+		Encoding:  "zstd",
+		Vary:      defaultCompressVary,
+		Types:     defaultCompressTypes,
+		MinLength: defaultCompressMinLength,
+	}
+}
+
+func newGzip(level int) func() Compressor {
+	return func() Compressor {
+		g, err := gzip.NewWriterLevel(ioutil.Discard, level)
+		if err != nil {
+			panic(err)
+		}
+		return g
+	}
+}
+
+func newBr(quality int) func() Compressor {
+	return func() Compressor {
+		return &brWriter{quality: quality}
+	}
 }
 
-func (w *brWriter) Reset(p io.Writer) {
-	w.Writer = cbrotli.NewWriter(p, cbrotli.WriterOptions{Quality: w.quality})
+func newZlib(level int) func() Compressor {
+	return func() Compressor {
+		z, err := zlib.NewWriterLevel(ioutil.Discard, level)
+		if err != nil {
+			panic(err)
+		}
+		return z
+	}
+}
+
+func newZstd(level zstd.EncoderLevel, windowSize int) func() Compressor {
+	return func() Compressor {
+		z, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(level),
+			zstd.WithWindowSize(windowSize),
+			zstd.WithEncoderConcurrency(1),
+		)
+		if err != nil {
+			panic(err)
+		}
+		return z
+	}
 }
 
 const (
 	defaultCompressVary      = true
 	defaultCompressTypes     = "application/xml+rss application/atom+xml application/javascript application/x-javascript application/json application/rss+xml application/vnd.ms-fontobject application/x-font-ttf application/x-web-app-manifest+json application/xhtml+xml application/xml font/opentype image/svg+xml image/x-icon text/css text/html text/plain text/x-component"
 	defaultCompressMinLength = 860
+	defaultZstdWindowSize    = 1 << 20
 )
 
-func Compress(config CompressConfig) func(http.Handler) http.Handler {
-	mapTypes := make(map[string]struct{})
-	for _, t := range strings.Split(config.Types, " ") {
-		t = strings.TrimSpace(t)
-		if t == "" {
-			continue
+// Compress negotiates Content-Encoding with the client using Accept-Encoding
+// q-values; when the client ranks several encodings equally, the order of
+// configs is the server preference.
+func Compress(configs ...CompressConfig) func(http.Handler) http.Handler {
+	encoders := make([]*compressEncoder, 0, len(configs))
+	encodings := make([]string, 0, len(configs))
+	vary := false
+	for _, config := range configs {
+		config := config
+
+		mapTypes := make(map[string]struct{})
+		for _, t := range strings.Split(config.Types, " ") {
+			t = strings.TrimSpace(t)
+			if t == "" {
+				continue
+			}
+			mapTypes[t] = struct{}{}
 		}
-		mapTypes[t] = struct{}{}
-	}
 
-	pool := &sync.Pool{
-		New: func() interface{} {
-			return config.New()
-		},
+		enc := &compressEncoder{
+			config: config,
+			types:  mapTypes,
+			pool: &sync.Pool{
+				New: func() interface{} {
+					return config.New()
+				},
+			},
+		}
+		if config.Cache != nil {
+			best := config.Best
+			if best == nil {
+				best = config.New
+			}
+			enc.bestPool = &sync.Pool{
+				New: func() interface{} {
+					return best()
+				},
+			}
+		}
+		encoders = append(encoders, enc)
+		encodings = append(encodings, config.Encoding)
+		vary = vary || config.Vary
 	}
 
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// skip if client not support
-			if !strings.Contains(r.Header.Get("Accept-Encoding"), config.Encoding) {
-				h.ServeHTTP(w, r)
-				return
-			}
-
 			// skip if web socket
 			if r.Header.Get("Sec-WebSocket-Key") != "" {
 				h.ServeHTTP(w, r)
@@ -124,24 +221,191 @@ func Compress(config CompressConfig) func(http.Handler) http.Handler {
 				return
 			}
 
-			if config.Vary {
-				hh.Add("Vary", "Accept-Encoding")
+			if vary {
+				addVary(hh, "Accept-Encoding")
+			}
+
+			i, ok := negotiateEncoding(r.Header.Values("Accept-Encoding"), encodings)
+			if !ok {
+				http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+				return
+			}
+
+			// identity
+			if i < 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			enc := encoders[i]
+
+			// compressed responses carry suffixed etags,
+			// the handler only knows the identity ones
+			var etagStripped bool
+			if inm := r.Header.Get("If-None-Match"); inm != "" {
+				if inm, etagStripped = stripETagEncoding(inm, enc.config.Encoding); etagStripped {
+					r = r.Clone(r.Context())
+					r.Header.Set("If-None-Match", inm)
+				}
 			}
 
 			cw := &compressWriter{
 				ResponseWriter: w,
-				pool:           pool,
-				encoding:       config.Encoding,
-				types:          mapTypes,
-				minLength:      config.MinLength,
+				pool:           enc.pool,
+				encoding:       enc.config.Encoding,
+				types:          enc.types,
+				minLength:      enc.config.MinLength,
+				head:           r.Method == http.MethodHead,
+				etagStripped:   etagStripped,
+			}
+			if enc.bestPool != nil {
+				cw.cache = enc.config.Cache
+				cw.bestPool = enc.bestPool
+				cw.cacheKey = r.Host + r.URL.RequestURI()
 			}
 			defer cw.Close()
 
 			h.ServeHTTP(cw, r)
+			cw.completed = true
 		})
 	}
 }
 
+// addVary adds field to Vary unless it is already there
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// etagWithEncoding suffixes an entity tag with the encoding,
+// "abc" becomes "abc-gzip", so caches do not mix up representations
+func etagWithEncoding(etag, encoding string) string {
+	if len(etag) < 2 || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+// stripETagEncoding adds the identity tag for every suffixed tag in an
+// If-None-Match list, the suffixed tag is kept in case it was the real one
+func stripETagEncoding(list, encoding string) (string, bool) {
+	suffix := "-" + encoding + `"`
+	tags := strings.Split(list, ",")
+	stripped := false
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if strings.HasSuffix(t, suffix) {
+			tags = append(tags, t[:len(t)-len(suffix)]+`"`)
+			stripped = true
+		}
+	}
+	if !stripped {
+		return list, false
+	}
+	for i := range tags {
+		tags[i] = strings.TrimSpace(tags[i])
+	}
+	return strings.Join(tags, ", "), true
+}
+
+type compressEncoder struct {
+	config   CompressConfig
+	types    map[string]struct{}
+	pool     *sync.Pool
+	bestPool *sync.Pool // nil when not caching
+}
+
+// parseAcceptEncoding parses Accept-Encoding header values into
+// a map of lower-cased coding to q-value
+func parseAcceptEncoding(values []string) map[string]float64 {
+	m := make(map[string]float64)
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			coding, q, valid := part, 1.0, true
+			if i := strings.Index(part, ";"); i >= 0 {
+				coding = part[:i]
+				for _, param := range strings.Split(part[i+1:], ";") {
+					p := strings.SplitN(param, "=", 2)
+					if len(p) != 2 || !strings.EqualFold(strings.TrimSpace(p[0]), "q") {
+						continue
+					}
+					f, err := strconv.ParseFloat(strings.TrimSpace(p[1]), 64)
+					if err != nil || f < 0 || f > 1 {
+						valid = false
+						break
+					}
+					q = f
+				}
+			}
+			if !valid {
+				continue
+			}
+
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+			if _, ok := m[coding]; ok {
+				continue
+			}
+			m[coding] = q
+		}
+	}
+	return m
+}
+
+// negotiateEncoding selects one of encodings, in server preference order,
+// returns -1 for identity, and false if nothing is acceptable
+func negotiateEncoding(values []string, encodings []string) (int, bool) {
+	// no Accept-Encoding, do not compress
+	if len(values) == 0 {
+		return -1, true
+	}
+
+	accept := parseAcceptEncoding(values)
+	wildcard, hasWildcard := accept["*"]
+
+	var (
+		best  = -1
+		bestQ float64
+	)
+	for i, enc := range encodings {
+		q, ok := accept[enc]
+		if !ok {
+			if !hasWildcard {
+				continue
+			}
+			q = wildcard
+		}
+		// strictly greater keeps server preference on ties
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+
+	// identity only wins over an encoding when the client ranks it higher
+	identityQ, explicit := accept["identity"]
+	if best >= 0 && (!explicit || identityQ <= bestQ) {
+		return best, true
+	}
+
+	// identity is acceptable unless explicitly excluded
+	if !explicit {
+		return -1, !hasWildcard || wildcard > 0
+	}
+	return -1, identityQ > 0
+}
+
 type Compressor interface {
 	io.Writer
 	io.Closer
@@ -157,9 +421,32 @@ type compressWriter struct {
 	types       map[string]struct{}
 	wroteHeader bool
 	minLength   int
+
+	// body is buffered until it can decide whether to compress,
+	// when the handler does not set Content-Length or Content-Type
+	code      int
+	buffering bool
+	buf       []byte
+
+	hijacked bool
+
+	head         bool // HEAD request, headers only
+	etagStripped bool // If-None-Match was matched against identity etags
+
+	// compressed body cache, body is compressed once, with bestPool when
+	// its length fits, and served from cache while the strong etag stays the same
+	cache     *CompressCache
+	bestPool  *sync.Pool
+	cacheKey  string
+	cacheBuf  *bytes.Buffer // nil when the body is not going into cache
+	fromCache bool          // body was written from cache, drop handler writes
+	completed bool          // handler returned without panic
 }
 
-func (w *compressWriter) init() {
+// sniffLength is the most http.DetectContentType will read
+const sniffLength = 512
+
+func (w *compressWriter) init(length int) {
 	h := w.Header()
 
 	// skip if already encode
@@ -167,14 +454,23 @@ func (w *compressWriter) init() {
 		return
 	}
 
+	// skip if partial content, byte ranges are of the identity body
+	if w.code == http.StatusPartialContent || h.Get("Content-Range") != "" {
+		return
+	}
+
+	// skip if upstream forbids transformation
+	if hasCacheDirective(h.Get("Cache-Control"), "no-transform") {
+		return
+	}
+
+	if sl := h.Get("Content-Length"); sl != "" {
+		length, _ = strconv.Atoi(sl)
+	}
+
 	// skip if length < min length
-	if w.minLength > 0 {
-		if sl := h.Get("Content-Length"); sl != "" {
-			l, _ := strconv.Atoi(sl)
-			if l > 0 && l < w.minLength {
-				return
-			}
-		}
+	if w.minLength > 0 && length >= 0 && length < w.minLength {
+		return
 	}
 
 	// skip if no match type
@@ -188,17 +484,131 @@ func (w *compressWriter) init() {
 		}
 	}
 
-	w.encoder = w.pool.Get().(Compressor)
-	w.encoder.Reset(w.ResponseWriter)
 	h.Del("Content-Length")
 	h.Set("Content-Encoding", w.encoding)
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", etagWithEncoding(etag, w.encoding))
+	}
+
+	// HEAD gets the same headers as GET, but no encoded body
+	if w.head {
+		return
+	}
+
+	// strong etag identifies the exact bytes, so compress them only once
+	if etag := h.Get("ETag"); w.cache != nil && w.code == http.StatusOK && etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.cacheKey += " " + w.encoding + " " + etag
+		if b, ok := w.cache.Get(w.cacheKey); ok {
+			h.Set("Content-Length", strconv.Itoa(len(b)))
+			w.buf = b
+			w.fromCache = true
+			return
+		}
+		// best level only for a body known to fit in cache,
+		// unknown length may turn out too big and is compressed as usual
+		if length > w.cache.maxEntry {
+			w.encoder = w.pool.Get().(Compressor)
+			w.encoder.Reset(w.ResponseWriter)
+			return
+		}
+		if length >= 0 {
+			w.pool = w.bestPool
+		}
+		w.cacheBuf = new(bytes.Buffer)
+		w.encoder = w.pool.Get().(Compressor)
+		w.encoder.Reset(cacheWriter{w})
+		return
+	}
+
+	w.encoder = w.pool.Get().(Compressor)
+	w.encoder.Reset(w.ResponseWriter)
+}
+
+// cacheWriter sends encoded bytes to client while keeping a copy for cache
+type cacheWriter struct {
+	w *compressWriter
+}
+
+func (cw cacheWriter) Write(p []byte) (int, error) {
+	w := cw.w
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil || w.cacheBuf != nil && w.cacheBuf.Len()+n > w.cache.maxEntry {
+		w.cacheBuf = nil
+	}
+	if w.cacheBuf != nil {
+		w.cacheBuf.Write(p[:n])
+	}
+	return n, err
+}
+
+func hasCacheDirective(cc, directive string) bool {
+	for _, d := range strings.Split(cc, ",") {
+		d = strings.TrimSpace(d)
+		if i := strings.Index(d, "="); i >= 0 {
+			d = d[:i]
+		}
+		if strings.EqualFold(d, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferLength returns how many bytes to buffer before deciding
+func (w *compressWriter) bufferLength() int {
+	n := w.minLength
+	if w.Header().Get("Content-Type") == "" && n < sniffLength {
+		n = sniffLength
+	}
+	return n
+}
+
+// start decides whether to compress, then writes the header and buffered body;
+// done reports that the handler finished, so the buffer is the whole body
+func (w *compressWriter) start(done bool) error {
+	w.buffering = false
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	length := -1
+	if done && !(w.head && len(w.buf) == 0) {
+		// HEAD handler may write no body, length is then unknown
+		length = len(w.buf)
+	}
+	w.init(length)
+	w.ResponseWriter.WriteHeader(w.code)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.encoder != nil {
+		_, err := w.encoder.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
 }
 
 func (w *compressWriter) Close() {
+	if w.buffering {
+		w.start(true)
+	}
 	if w.encoder == nil {
 		return
 	}
+	if w.hijacked {
+		// connection is no longer ours, finish the stream into nothing
+		w.encoder.Reset(ioutil.Discard)
+	}
 	w.encoder.Close()
+	if !w.hijacked && w.completed && w.cacheBuf != nil {
+		w.cache.Add(w.cacheKey, w.cacheBuf.Bytes())
+	}
 	w.pool.Put(w.encoder)
 }
 
@@ -206,6 +616,19 @@ func (w *compressWriter) Write(b []byte) (int, error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
+	if w.buffering {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.bufferLength() {
+			return len(b), nil
+		}
+		if err := w.start(false); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.fromCache {
+		return len(b), nil
+	}
 	if w.encoder != nil {
 		return w.encoder.Write(b)
 	}
@@ -216,7 +639,92 @@ func (w *compressWriter) WriteHeader(code int) {
 	if w.wroteHeader {
 		return
 	}
+
+	// informational, the final header is still to come
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
 	w.wroteHeader = true
-	w.init()
-	w.ResponseWriter.WriteHeader(code)
+	w.code = code
+
+	h := w.Header()
+
+	// no body to encode
+	switch code {
+	case http.StatusNotModified:
+		if w.etagStripped {
+			if etag := h.Get("ETag"); etag != "" {
+				h.Set("ETag", etagWithEncoding(etag, w.encoding))
+			}
+		}
+		fallthrough
+	case http.StatusNoContent, http.StatusSwitchingProtocols:
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	// HEAD buffers too, body net/http discards still decides like GET
+	if h.Get("Content-Encoding") == "" &&
+		(h.Get("Content-Type") == "" || w.minLength > 0 && h.Get("Content-Length") == "") {
+		w.buffering = true
+		return
+	}
+	w.start(false)
+}
+
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		w.start(false)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the raw connection, anything written after this
+// must not go through the encoder
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.buffering = false
+	w.buf = nil
+	return conn, rw, nil
+}
+
+// ReadFrom keeps sendfile for responses that are not compressed
+func (w *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering || w.encoder != nil || w.fromCache {
+		return io.Copy(writerOnly{w}, r)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{w.ResponseWriter}, r)
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writerOnly hides ReadFrom from io.Copy
+type writerOnly struct {
+	io.Writer
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchJSON returns a json api response of about n bytes
+func benchJSON(n int) []byte {
+	type item struct {
+		ID        int      `json:"id"`
+		Name      string   `json:"name"`
+		Email     string   `json:"email"`
+		Active    bool     `json:"active"`
+		Score     float64  `json:"score"`
+		Tags      []string `json:"tags"`
+		CreatedAt string   `json:"created_at"`
+	}
+
+	var items []item
+	for i := 0; ; i++ {
+		items = append(items, item{
+			ID:        i,
+			Name:      fmt.Sprintf("user %d", i),
+			Email:     fmt.Sprintf("user%d@example.com", i),
+			Active:    i%3 != 0,
+			Score:     float64(i*37%1000) / 10,
+			Tags:      []string{"tag" + fmt.Sprint(i%7), "group" + fmt.Sprint(i%11)},
+			CreatedAt: fmt.Sprintf("2020-%02d-%02dT10:00:00Z", i%12+1, i%28+1),
+		})
+		if i%8 == 0 {
+			b, _ := json.Marshal(map[string]interface{}{"items": items})
+			if len(b) >= n {
+				return b
+			}
+		}
+	}
+}
+
+func benchmarkCompressor(b *testing.B, config CompressConfig) {
+	for _, size := range []int{1 << 10, 16 << 10, 256 << 10} {
+		data := benchJSON(size)
+		b.Run(fmt.Sprintf("%s/%dKB", config.Encoding, size>>10), func(b *testing.B) {
+			enc := config.New()
+
+			var out bytes.Buffer
+			enc.Reset(&out)
+			enc.Write(data)
+			enc.Close()
+			ratio := float64(out.Len()) / float64(len(data))
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				enc.Reset(ioutil.Discard)
+				enc.Write(data)
+				enc.Close()
+			}
+			b.ReportMetric(ratio, "ratio")
+		})
+	}
+}
+
+func BenchmarkGzip(b *testing.B)    { benchmarkCompressor(b, Gzip()) }
+func BenchmarkDeflate(b *testing.B) { benchmarkCompressor(b, Deflate()) }
+func BenchmarkZstd(b *testing.B)    { benchmarkCompressor(b, Zstd()) }
+func BenchmarkBr(b *testing.B)      { benchmarkCompressor(b, Br()) }
+
+// compressors covers every encoder, each flushes and closes its own way
+var compressors = []CompressConfig{Gzip(), Deflate(), Zstd(), Br()}
+
+func compressAll(config CompressConfig) func(http.Handler) http.Handler {
+	config.MinLength = 0
+	return Compress(config)
+}
+
+func serveStack(t *testing.T, stack func(http.Handler) http.Handler, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(stack(h))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// getEncoded requests url accepting only encoding, body is left encoded
+func getEncoded(t *testing.T, url, encoding string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	// set by hand, so transport does not decode it
+	req.Header.Set("Accept-Encoding", encoding)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func getGzip(t *testing.T, url string) *http.Response {
+	t.Helper()
+	return getEncoded(t, url, "gzip")
+}
+
+// decodeBody checks Content-Encoding and decodes resp body with it
+func decodeBody(t *testing.T, resp *http.Response, encoding string) io.Reader {
+	t.Helper()
+	if ce := resp.Header.Get("Content-Encoding"); ce != encoding {
+		t.Fatalf("Content-Encoding = %q, want %q", ce, encoding)
+	}
+	d, err := decoders[encoding](resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestCompressFlush(t *testing.T) {
+	flushers := map[string]func(w http.ResponseWriter) error{
+		"Flusher": func(w http.ResponseWriter) error {
+			w.(http.Flusher).Flush()
+			return nil
+		},
+		"ResponseController": func(w http.ResponseWriter) error {
+			return http.NewResponseController(w).Flush()
+		},
+	}
+
+	for _, config := range compressors {
+		for name, flush := range flushers {
+			config := config
+			t.Run(config.Encoding+"/"+name, func(t *testing.T) {
+				release := make(chan struct{})
+				defer close(release)
+
+				srv := serveStack(t, compressAll(config), func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "text/plain")
+					io.WriteString(w, "first\n")
+					if err := flush(w); err != nil {
+						t.Errorf("flush: %v", err)
+					}
+					// encoder must emit a complete block on flush, not wait for Close
+					<-release
+					io.WriteString(w, "second\n")
+				})
+
+				resp := getEncoded(t, srv.URL, config.Encoding)
+				line, err := bufio.NewReader(decodeBody(t, resp, config.Encoding)).ReadString('\n')
+				if err != nil || line != "first\n" {
+					t.Fatalf("decoded flushed line = %q, %v", line, err)
+				}
+			})
+		}
+	}
+}
+
+func TestCompressHijack(t *testing.T) {
+	hijackers := map[string]func(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error){
+		"Hijacker": func(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+			return w.(http.Hijacker).Hijack()
+		},
+		"ResponseController": func(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+			return http.NewResponseController(w).Hijack()
+		},
+	}
+
+	for _, config := range compressors {
+		for name, hijack := range hijackers {
+			config := config
+			t.Run(config.Encoding+"/"+name, func(t *testing.T) {
+				srv := serveStack(t, compressAll(config), func(w http.ResponseWriter, r *http.Request) {
+					// compressible type, headers set before hijack must not leak
+					w.Header().Set("Content-Type", "text/plain")
+					conn, rw, err := hijack(w)
+					if err != nil {
+						t.Errorf("hijack: %v", err)
+						return
+					}
+					defer conn.Close()
+					rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 3\r\nConnection: close\r\n\r\nraw")
+					rw.Flush()
+				})
+
+				resp := getEncoded(t, srv.URL, config.Encoding)
+				if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+					t.Fatalf("hijacked response has Content-Encoding %q", ce)
+				}
+				b, err := ioutil.ReadAll(resp.Body)
+				if err != nil || string(b) != "raw" {
+					t.Fatalf("body = %q, %v, want bytes written to the conn", b, err)
+				}
+			})
+		}
+	}
+}
+
+func TestCompressReadFrom(t *testing.T) {
+	data := benchJSON(64 << 10)
+
+	for _, config := range compressors {
+		config := config
+		t.Run(config.Encoding, func(t *testing.T) {
+			srv := serveStack(t, compressAll(config), func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if _, ok := w.(io.ReaderFrom); !ok {
+					t.Errorf("%T does not implement io.ReaderFrom", w)
+				}
+				io.Copy(w, bytes.NewReader(data))
+			})
+
+			resp := getEncoded(t, srv.URL, config.Encoding)
+			b, err := ioutil.ReadAll(decodeBody(t, resp, config.Encoding))
+			if err != nil || !bytes.Equal(b, data) {
+				t.Fatalf("decoded %d bytes, %v, want %d bytes", len(b), err, len(data))
+			}
+
+			// not accepted, ReadFrom passes through to the server
+			resp = getEncoded(t, srv.URL, "identity")
+			b, _ = ioutil.ReadAll(resp.Body)
+			if !bytes.Equal(b, data) {
+				t.Fatalf("identity body %d bytes, want %d bytes", len(b), len(data))
+			}
+		})
+	}
+}
+
+func TestCompressResponseControllerDeadlines(t *testing.T) {
+	for _, config := range compressors {
+		config := config
+		t.Run(config.Encoding, func(t *testing.T) {
+			srv := serveStack(t, compressAll(config), func(w http.ResponseWriter, r *http.Request) {
+				// compressWriter has no deadlines, controller finds them through Unwrap
+				rc := http.NewResponseController(w)
+				if err := rc.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+					t.Errorf("SetWriteDeadline: %v", err)
+				}
+				if err := rc.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+					t.Errorf("SetReadDeadline: %v", err)
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "ok")
+			})
+
+			resp := getEncoded(t, srv.URL, config.Encoding)
+			b, err := ioutil.ReadAll(decodeBody(t, resp, config.Encoding))
+			if err != nil || string(b) != "ok" {
+				t.Fatalf("decoded %q, %v, want ok", b, err)
+			}
+		})
+	}
+}
+
+func TestHeadHeadersMatchGet(t *testing.T) {
+	body := benchJSON(4 << 10)
+	srv := serveStack(t, Compress(Gzip()), func(w http.ResponseWriter, r *http.Request) {
+		// no Content-Type nor Content-Length, both sniffed from body
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(body)
+	})
+
+	headers := make(map[string]http.Header)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req, _ := http.NewRequest(method, srv.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		headers[method] = resp.Header
+	}
+
+	for _, k := range []string{"Content-Encoding", "Content-Type", "ETag", "Vary"} {
+		get, head := headers[http.MethodGet].Get(k), headers[http.MethodHead].Get(k)
+		if get != head {
+			t.Errorf("%s: GET %q, HEAD %q", k, get, head)
+		}
+	}
+	if ce := headers[http.MethodGet].Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("GET Content-Encoding = %q, want gzip", ce)
+	}
+}
+
+func TestCacheBestLevelOnlyWhenFits(t *testing.T) {
+	cache := NewCompressCache(64 << 10)
+	small, large := benchJSON(4<<10), benchJSON(64<<10)
+
+	tests := []struct {
+		name     string
+		body     []byte
+		length   bool
+		wantBest bool
+	}{
+		{"fits", small, true, true},
+		{"too big", large, true, false},
+		{"unknown length", large, false, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var best int32
+			config := Gzip()
+			config.Cache = cache
+			config.Best = func() Compressor {
+				atomic.AddInt32(&best, 1)
+				return Gzip().New()
+			}
+
+			etag := `"v` + strconv.Itoa(i) + `"`
+			srv := serveStack(t, Compress(config), func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", etag)
+				if tt.length {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				w.Write(tt.body)
+				if !tt.length {
+					// flush before the end, so length stays unknown
+					w.(http.Flusher).Flush()
+				}
+			})
+
+			resp := getGzip(t, srv.URL)
+			zr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(zr)
+			if err != nil || !bytes.Equal(b, tt.body) {
+				t.Fatalf("decoded %d bytes, %v, want %d bytes", len(b), err, len(tt.body))
+			}
+			if got := atomic.LoadInt32(&best) > 0; got != tt.wantBest {
+				t.Fatalf("best level used = %v, want %v", got, tt.wantBest)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+)
+
+// precompressedSiblings in server preference order
+var precompressedSiblings = []struct {
+	encoding string
+	ext      string
+}{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// Precompressed serves files from root like http.FileServer, but serves
+// foo.js.br, foo.js.zst or foo.js.gz instead of foo.js when client accepts it
+func Precompressed(root string) http.Handler {
+	dir := http.Dir(root)
+	fs := http.FileServer(dir)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+
+		var (
+			encodings []string
+			exts      []string
+		)
+		for _, s := range precompressedSiblings {
+			f, err := dir.Open(name + s.ext)
+			if err != nil {
+				continue
+			}
+			fi, err := f.Stat()
+			f.Close()
+			if err != nil || fi.IsDir() {
+				continue
+			}
+			encodings = append(encodings, s.encoding)
+			exts = append(exts, s.ext)
+		}
+		if len(encodings) == 0 {
+			fs.ServeHTTP(w, r)
+			return
+		}
+
+		addVary(w.Header(), "Accept-Encoding")
+
+		i, _ := negotiateEncoding(r.Header.Values("Accept-Encoding"), encodings)
+		if i < 0 {
+			fs.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := dir.Open(name + exts[i])
+		if err != nil {
+			fs.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			fs.ServeHTTP(w, r)
+			return
+		}
+
+		// type of the original file, not of the compressed one
+		ct := mime.TypeByExtension(path.Ext(name))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		h := w.Header()
+		h.Set("Content-Type", ct)
+		h.Set("Content-Encoding", encodings[i])
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	htpasswdPath = "" // ex. "htpasswd", bcrypt only (htpasswd -B), empty to disable auth
+	proxyRealm   = "proxy"
+
+	// proxyACLs are destination host patterns allowed per user,
+	// user not in the map can connect to any destination
+	proxyACLs = map[string][]string{
+		// "alice": {"*.example.com", "10.0.0.0/8"},
+	}
+)
+
+// htpasswd verifies users from htpasswd file
+type htpasswd struct {
+	filename string
+	acls     map[string][]func(host string) bool
+
+	mu       sync.RWMutex
+	users    map[string][]byte
+	verified map[string][32]byte // bcrypt is slow, remember password already verified
+}
+
+func newHtpasswd(filename string, acls map[string][]string) (*htpasswd, error) {
+	h := &htpasswd{
+		filename: filename,
+		acls:     make(map[string][]func(string) bool),
+	}
+	for user, patterns := range acls {
+		for _, p := range patterns {
+			match, err := compileHostPattern(p)
+			if err != nil {
+				return nil, fmt.Errorf("acl %s: %v", user, err)
+			}
+			h.acls[user] = append(h.acls[user], match)
+		}
+	}
+
+	err := h.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reloads users from file, keeps current users on error
+func (h *htpasswd) Reload() error {
+	b, err := ioutil.ReadFile(h.filename)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		i := strings.Index(s, ":")
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: invalid line", h.filename, line)
+		}
+		hash := s[i+1:]
+		if !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("%s:%d: only bcrypt hash supported", h.filename, line)
+		}
+		users[s[:i]] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.verified = make(map[string][32]byte)
+	h.mu.Unlock()
+	return nil
+}
+
+// Verify returns true if user and password are valid
+func (h *htpasswd) Verify(user, password string) bool {
+	sum := sha256.Sum256([]byte(password))
+
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	known, verified := h.verified[user]
+	h.mu.RUnlock()
+
+	if !ok {
+		return false
+	}
+	if verified && known == sum {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	h.mu.Lock()
+	h.verified[user] = sum
+	h.mu.Unlock()
+	return true
+}
+
+// Allow returns true if user can connect to target
+func (h *htpasswd) Allow(user, target string) bool {
+	acl, ok := h.acls[user]
+	if !ok {
+		return true
+	}
+	host := hostOnly(target)
+	for _, match := range acl {
+		if match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyAuth authenticates request from Proxy-Authorization header,
+// responds 407 and returns false if failed
+func proxyAuth(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !ok || !users.Verify(user, password) {
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyRealm))
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return "", false
+	}
+
+	// do not leak credential to upstream
+	r.Header.Del("Proxy-Authorization")
+	return user, true
+}
+
+func parseProxyAuthorization(s string) (user, password string, ok bool) {
+	const prefix = "basic "
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return
+	}
+	i := bytes.IndexByte(b, ':')
+	if i < 0 {
+		return
+	}
+	return string(b[:i]), string(b[i+1:]), true
+}
+
+type contextKey struct {
+	name string
+}
+
+var userContextKey = &contextKey{"user"}
+
+// userFromContext returns authenticated username, empty if auth disabled
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey).(string)
+	return user
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+	caHost     = "proxy.ca" // browse http://proxy.ca through the proxy to download ca certificate
+)
+
+// loadCA loads ca certificate and private key from pem files
+func loadCA(crtFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	crtBytes, err := ioutil.ReadFile(crtFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	crtPem, _ := pem.Decode(crtBytes)
+	if crtPem == nil || crtPem.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("%s: no certificate pem block", crtFile)
+	}
+	crt, err := x509.ParseCertificate(crtPem.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", crtFile, err)
+	}
+	if !crt.IsCA {
+		return nil, nil, fmt.Errorf("%s: not a ca certificate", crtFile)
+	}
+
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPem, _ := pem.Decode(keyBytes)
+	if keyPem == nil {
+		return nil, nil, fmt.Errorf("%s: no private key pem block", keyFile)
+	}
+	priv, err := parsePrivateKey(keyPem)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+
+	return crt, priv, nil
+}
+
+func parsePrivateKey(b *pem.Block) (crypto.Signer, error) {
+	switch b.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(b.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(b.Bytes)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key %T", k)
+		}
+		return priv, nil
+	default:
+		return nil, fmt.Errorf("unsupported pem block %q", b.Type)
+	}
+}
+
+func runCA(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: proxy ca <init|export|install> [flags]")
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "init":
+		err = runCAInit(args[1:])
+	case "export":
+		err = runCAExport(args[1:])
+	case "install":
+		err = runCAInstall(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runCAInit(args []string) error {
+	fs := flag.NewFlagSet("ca init", flag.ExitOnError)
+	name := fs.String("name", "Proxy CA", "ca common name")
+	org := fs.String("org", "", "ca organization")
+	years := fs.Int("years", 10, "validity in years")
+	permit := fs.String("permit", "", "comma separated dns domains the ca may issue for, ex. example.com,.internal")
+	exclude := fs.String("exclude", "", "comma separated dns domains the ca must not issue for")
+	permitIP := fs.String("permit-ip", "", "comma separated ip ranges the ca may issue for, ex. 10.0.0.0/8")
+	force := fs.Bool("force", false, "overwrite existing ca")
+	fs.Parse(args)
+
+	if !*force {
+		for _, fn := range []string{caCertFile, caKeyFile} {
+			if _, err := os.Stat(fn); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite", fn)
+			}
+		}
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	tmpl := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: *name,
+		},
+		SerialNumber:          serial,
+		NotBefore:             now.Add(-leafBackdate),
+		NotAfter:              now.AddDate(*years, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		PermittedDNSDomains:   splitList(*permit),
+		ExcludedDNSDomains:    splitList(*exclude),
+	}
+	if *org != "" {
+		tmpl.Subject.Organization = []string{*org}
+	}
+	for _, s := range splitList(*permitIP) {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		tmpl.PermittedIPRanges = append(tmpl.PermittedIPRanges, n)
+	}
+	tmpl.PermittedDNSDomainsCritical = len(tmpl.PermittedDNSDomains) > 0 || len(tmpl.PermittedIPRanges) > 0
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(caKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("generated %s and %s", caCertFile, caKeyFile)
+	return nil
+}
+
+func runCAExport(args []string) error {
+	fs := flag.NewFlagSet("ca export", flag.ExitOnError)
+	format := fs.String("format", "pem", "output format: pem, der or p12")
+	out := fs.String("out", "", "output file, empty for stdout")
+	withKey := fs.Bool("key", false, "include private key (p12 only)")
+	password := fs.String("password", "", "p12 password")
+	fs.Parse(args)
+
+	if *withKey && *format != "p12" {
+		return errors.New("-key only supported with p12 format")
+	}
+
+	caCrt, caPriv, err := loadCA(caCertFile, caKeyFile)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	switch *format {
+	case "pem":
+		b = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCrt.Raw})
+	case "der":
+		b = caCrt.Raw
+	case "p12":
+		if *withKey {
+			b, err = pkcs12.Modern.Encode(caPriv, caCrt, nil, *password)
+		} else {
+			b, err = pkcs12.Modern.EncodeTrustStore([]*x509.Certificate{caCrt}, *password)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	perm := os.FileMode(0644)
+	if *withKey {
+		perm = 0600
+	}
+	return ioutil.WriteFile(*out, b, perm)
+}
+
+func runCAInstall(args []string) error {
+	fs := flag.NewFlagSet("ca install", flag.ExitOnError)
+	store := fs.String("store", "", "trust store to print instruction for, empty for all")
+	fs.Parse(args)
+
+	if *store != "" {
+		for _, ins := range caInstructions {
+			if ins.Store == *store {
+				printInstruction(ins)
+				return nil
+			}
+		}
+		var names []string
+		for _, ins := range caInstructions {
+			names = append(names, ins.Store)
+		}
+		return fmt.Errorf("unknown store %q, available: %s", *store, strings.Join(names, ", "))
+	}
+
+	for _, ins := range caInstructions {
+		printInstruction(ins)
+	}
+	return nil
+}
+
+func printInstruction(ins caInstruction) {
+	fmt.Printf("# %s\n", ins.Name)
+	for _, step := range ins.Steps {
+		fmt.Printf("  %s\n", strings.Replace(step, "{ca}", caCertFile, -1))
+	}
+	fmt.Println()
+}
+
+type caInstruction struct {
+	Store string
+	Name  string
+	Steps []string
+}
+
+var caInstructions = []caInstruction{
+	{"macos", "macOS", []string{
+		"sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain {ca}",
+	}},
+	{"debian", "Debian / Ubuntu", []string{
+		"sudo cp {ca} /usr/local/share/ca-certificates/proxy-ca.crt",
+		"sudo update-ca-certificates",
+	}},
+	{"fedora", "Fedora / RHEL", []string{
+		"sudo cp {ca} /etc/pki/ca-trust/source/anchors/proxy-ca.crt",
+		"sudo update-ca-trust",
+	}},
+	{"windows", "Windows", []string{
+		"certutil -addstore -f ROOT {ca}",
+	}},
+	{"firefox", "Firefox (NSS)", []string{
+		"certutil -A -n proxy-ca -t C,, -i {ca} -d sql:<firefox profile directory>",
+		"or Settings > Privacy & Security > Certificates > View Certificates > Authorities > Import",
+	}},
+	{"java", "Java", []string{
+		"keytool -importcert -noprompt -alias proxy-ca -file {ca} -cacerts -storepass changeit",
+	}},
+	{"android", "Android", []string{
+		"browse http://" + caHost + " through the proxy and download the certificate",
+		"Settings > Security > Encryption & credentials > Install a certificate > CA certificate",
+	}},
+	{"ios", "iOS", []string{
+		"browse http://" + caHost + " through the proxy with Safari and download the certificate",
+		"Settings > General > VPN & Device Management > install the downloaded profile",
+		"Settings > General > About > Certificate Trust Settings > enable full trust",
+	}},
+}
+
+func splitList(s string) []string {
+	var xs []string
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x != "" {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+// isLocalRequest returns true if request is for proxy itself, not to be proxied,
+// either direct request or to caHost through the proxy
+func isLocalRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return false
+	}
+	if !r.URL.IsAbs() {
+		return true
+	}
+	host := r.URL.Hostname()
+	return host == caHost
+}
+
+func caHandler(caCrt *x509.Certificate) http.Handler {
+	crtPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCrt.Raw})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		caPage.Execute(w, struct {
+			Name         string
+			Instructions []caInstruction
+		}{caCrt.Subject.CommonName, caInstructions})
+	})
+	mux.HandleFunc("/ca.crt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(crtPem)
+	})
+	mux.HandleFunc("/ca.der", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(caCrt.Raw)
+	})
+	return mux
+}
+
+var caPage = template.Must(template.New("").Parse(`<!doctype html>
+<title>{{.Name}}</title>
+<h1>{{.Name}}</h1>
+<p>Download <a href="/ca.crt">ca.crt</a> (PEM) or <a href="/ca.der">ca.der</a> (DER)</p>
+{{range .Instructions}}
+<h2>{{.Name}}</h2>
+<ul>{{range .Steps}}<li><code>{{.}}</code></li>{{end}}</ul>
+{{end}}
+`))
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"time"
+)
+
+var (
+	leafKeyType   = "ecdsa"   // ecdsa (P-256) or rsa (2048)
+	leafSharedKey = true      // sign all leaf certificates with one pre-generated key
+	leafBackdate  = time.Hour // move NotBefore back for client with clock skew
+	leafValidity  = 365 * 24 * time.Hour
+)
+
+// certIssuer issues leaf certificates signed by ca
+type certIssuer struct {
+	caCrt     *x509.Certificate
+	caPriv    crypto.Signer
+	sharedKey crypto.Signer
+}
+
+func newCertIssuer(caCrt *x509.Certificate, caPriv crypto.Signer) (*certIssuer, error) {
+	iss := &certIssuer{
+		caCrt:  caCrt,
+		caPriv: caPriv,
+	}
+	if leafSharedKey {
+		var err error
+		iss.sharedKey, err = generateKey(leafKeyType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return iss, nil
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+}
+
+// Issue generates certificate for host, host can be a dns name or an ip address
+func (iss *certIssuer) Issue(host string) (*tls.Certificate, error) {
+	log.Println("generate cert", host)
+
+	privKey := iss.sharedKey
+	if privKey == nil {
+		var err error
+		privKey, err = generateKey(leafKeyType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	x509Crt := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: host,
+		},
+		SerialNumber: serial,
+		NotBefore:    now.Add(-leafBackdate),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if _, ok := privKey.(*rsa.PrivateKey); ok {
+		x509Crt.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		x509Crt.IPAddresses = []net.IP{ip}
+	} else {
+		x509Crt.DNSNames = []string{host}
+	}
+
+	// never outlive ca
+	if x509Crt.NotAfter.After(iss.caCrt.NotAfter) {
+		x509Crt.NotAfter = iss.caCrt.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, x509Crt, iss.caCrt, privKey.Public(), iss.caPriv)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, iss.caCrt.Raw},
+		PrivateKey:  privKey,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certRenewBefore evicts certificate before it expires,
+// so client never see an expired certificate
+const certRenewBefore = 24 * time.Hour
+
+// certCache is a lru cache for generated leaf certificates,
+// concurrent calls for the same host share a single generation
+type certCache struct {
+	size     int
+	dir      string            // persist certificates to dir, empty to disable
+	ca       *x509.Certificate // certificates on disk not signed by ca are regenerated
+	generate func(host string) (*tls.Certificate, error)
+
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+	inflight map[string]*certCall
+}
+
+type certEntry struct {
+	host string
+	crt  *tls.Certificate
+}
+
+type certCall struct {
+	wg  sync.WaitGroup
+	crt *tls.Certificate
+	err error
+}
+
+func newCertCache(size int, dir string, ca *x509.Certificate, generate func(host string) (*tls.Certificate, error)) *certCache {
+	return &certCache{
+		size:     size,
+		dir:      dir,
+		ca:       ca,
+		generate: generate,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		inflight: make(map[string]*certCall),
+	}
+}
+
+func (c *certCache) Get(host string) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if el, ok := c.items[host]; ok {
+		crt := el.Value.(*certEntry).crt
+		if certValid(crt) {
+			c.ll.MoveToFront(el)
+			c.mu.Unlock()
+			return crt, nil
+		}
+		c.ll.Remove(el)
+		delete(c.items, host)
+	}
+	if call, ok := c.inflight[host]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.crt, call.err
+	}
+	call := &certCall{}
+	call.wg.Add(1)
+	c.inflight[host] = call
+	c.mu.Unlock()
+
+	call.crt, call.err = c.load(host)
+
+	c.mu.Lock()
+	delete(c.inflight, host)
+	if call.err == nil {
+		c.add(host, call.crt)
+	}
+	c.mu.Unlock()
+	call.wg.Done()
+
+	return call.crt, call.err
+}
+
+// add adds certificate to cache, must hold c.mu
+func (c *certCache) add(host string, crt *tls.Certificate) {
+	c.items[host] = c.ll.PushFront(&certEntry{host: host, crt: crt})
+	for c.size > 0 && c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*certEntry).host)
+	}
+}
+
+// load loads certificate from disk, or generate a new one
+func (c *certCache) load(host string) (*tls.Certificate, error) {
+	if c.dir != "" {
+		// leaf from before "ca init -force" is signed by the old ca
+		crt, err := readCert(c.filename(host))
+		if err == nil && certValid(crt) && crt.Leaf.CheckSignatureFrom(c.ca) == nil {
+			return crt, nil
+		}
+	}
+
+	crt, err := c.generate(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dir != "" {
+		err = writeCert(c.filename(host), crt)
+		if err != nil {
+			// still serve from memory
+			log.Printf("persist cert %s: %v", host, err)
+		}
+	}
+
+	return crt, nil
+}
+
+func (c *certCache) filename(host string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, host)
+	if name == "" {
+		name = "_"
+	}
+	return filepath.Join(c.dir, name+".pem")
+}
+
+func certValid(crt *tls.Certificate) bool {
+	if crt == nil || crt.Leaf == nil {
+		return false
+	}
+	return time.Now().Add(certRenewBefore).Before(crt.Leaf.NotAfter)
+}
+
+// readCert reads certificate chain and private key from a pem file
+func readCert(filename string) (*tls.Certificate, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, err
+	}
+	crt.Leaf, err = x509.ParseCertificate(crt.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &crt, nil
+}
+
+// writeCert writes certificate chain and private key into a pem file
+func writeCert(filename string, crt *tls.Certificate) error {
+	if len(crt.Certificate) == 0 {
+		return errors.New("empty certificate")
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(crt.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	for _, der := range crt.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	// write to temp file then rename, reader never see partial file
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,11 @@
+module proxy
+
+go 1.19
+
+require (
+	golang.org/x/crypto v0.11.0
+	golang.org/x/net v0.12.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
+)
+
+require golang.org/x/text v0.11.0 // indirect
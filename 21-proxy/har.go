@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	harDir           = "" // ex. "har", empty to disable recording
+	harMaxBodySize   = int64(1 << 20)
+	harMaxEntries    = 1000 // rotate to a new file after max entries
+	harFlushInterval = 10 * time.Second
+	harHosts         = []string{} // record only matched host patterns, empty for all
+)
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	User            string      `json:"_user,omitempty"` // authenticated proxy user
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	BodyHash    string         `json:"_bodySha256,omitempty"` // hash of full body, for replay
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings in milliseconds, -1 if not applicable
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harRecorder writes captured entries into har files
+type harRecorder struct {
+	dir         string
+	maxBodySize int64
+	maxEntries  int
+	hosts       []func(host string) bool
+
+	mu      sync.Mutex
+	name    string // time of first entry, file is created on flush
+	seq     int    // suffix keeps names unique within the same millisecond
+	file    *os.File
+	end     int64      // offset of closing brackets, entries are written here
+	written int        // entries in file
+	pending []harEntry // entries not yet in file
+}
+
+func newHARRecorder(dir string, hosts []string) (*harRecorder, error) {
+	rec := &harRecorder{
+		dir:         dir,
+		maxBodySize: harMaxBodySize,
+		maxEntries:  harMaxEntries,
+	}
+	for _, p := range hosts {
+		match, err := compileHostPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		rec.hosts = append(rec.hosts, match)
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for range time.Tick(harFlushInterval) {
+			rec.mu.Lock()
+			rec.flush()
+			rec.mu.Unlock()
+		}
+	}()
+
+	return rec, nil
+}
+
+// Match returns true if requests to target should be recorded
+func (rec *harRecorder) Match(target string) bool {
+	if len(rec.hosts) == 0 {
+		return true
+	}
+	host := hostOnly(target)
+	for _, match := range rec.hosts {
+		if match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rec *harRecorder) add(entry harEntry) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.name == "" {
+		rec.name = time.Now().Format("20060102-150405.000")
+	}
+	rec.pending = append(rec.pending, entry)
+
+	if rec.written+len(rec.pending) >= rec.maxEntries {
+		rec.flush()
+		rec.closeFile()
+	}
+}
+
+// Close writes pending entries, call before exit
+func (rec *harRecorder) Close() {
+	rec.mu.Lock()
+	rec.flush()
+	rec.closeFile()
+	rec.mu.Unlock()
+}
+
+// harHeader and harTrailer surround entries in har file
+var harHeader, harTrailer = func() ([]byte, []byte) {
+	b, _ := json.Marshal(har{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "course-reverse-proxy", Version: "1.0"},
+			Entries: []harEntry{},
+		},
+	})
+	i := bytes.LastIndex(b, []byte("[]")) + 1
+	return b[:i], b[i:]
+}()
+
+// flush appends pending entries to current file, must hold rec.mu.
+// Entries overwrite the closing brackets, which are written again after them,
+// so the file is valid har between flushes.
+func (rec *harRecorder) flush() {
+	if len(rec.pending) == 0 {
+		return
+	}
+
+	if rec.file == nil {
+		// never overwrite an existing archive
+		var f *os.File
+		var err error
+		for {
+			filename := filepath.Join(rec.dir, rec.name+"-"+strconv.Itoa(rec.seq)+".har")
+			rec.seq++
+			f, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if !os.IsExist(err) {
+				break
+			}
+		}
+		if err != nil {
+			log.Println("har:", err)
+			return
+		}
+		_, err = f.Write(harHeader)
+		if err != nil {
+			log.Println("har:", err)
+			f.Close()
+			return
+		}
+		rec.file = f
+		rec.end = int64(len(harHeader))
+	}
+
+	var buf bytes.Buffer
+	written := rec.written
+	for _, entry := range rec.pending {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			log.Println("har:", err)
+			continue
+		}
+		if written > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(b)
+		written++
+	}
+	n := int64(buf.Len())
+	buf.Write(harTrailer)
+
+	// on error pending entries are retried at the same offset
+	_, err := rec.file.WriteAt(buf.Bytes(), rec.end)
+	if err != nil {
+		log.Println("har:", err)
+		return
+	}
+	rec.end += n
+	rec.written = written
+	rec.pending = nil
+}
+
+// closeFile starts a new file on next add, must hold rec.mu
+func (rec *harRecorder) closeFile() {
+	if rec.file != nil {
+		err := rec.file.Close()
+		if err != nil {
+			log.Println("har:", err)
+		}
+	}
+	rec.file = nil
+	rec.name = ""
+	rec.written = 0
+	rec.pending = nil
+}
+
+// Capture starts capture request, returned capture's Request must be used to send to upstream
+func (rec *harRecorder) Capture(r *http.Request) *harCapture {
+	c := &harCapture{
+		rec:      rec,
+		start:    time.Now(),
+		reqBody:  limitedBuffer{limit: rec.maxBodySize},
+		reqHash:  sha256.New(),
+		respBody: limitedBuffer{limit: rec.maxBodySize},
+	}
+	c.Request = r.WithContext(httptrace.WithClientTrace(r.Context(), c.trace()))
+	if r.Body != nil && r.Body != http.NoBody {
+		// transport reads body in its own goroutine, possibly after Done
+		c.Request.Body = readCloser{io.TeeReader(r.Body, lockedWriter{&c.mu, io.MultiWriter(&c.reqBody, c.reqHash)}), r.Body}
+	}
+	return c
+}
+
+// harCapture collects a single request/response pair
+type harCapture struct {
+	Request *http.Request
+
+	rec      *harRecorder
+	start    time.Time
+	reqBody  limitedBuffer
+	reqHash  hash.Hash
+	respBody limitedBuffer
+	resp     *http.Response // snapshot from upstream, before rewrite
+	err      error
+
+	mu                     sync.Mutex // guards fields below and reqBody, reqHash
+	dnsStart, dnsDone      time.Time
+	connectStart, connDone time.Time
+	tlsStart, tlsDone      time.Time
+	gotConn, wroteRequest  time.Time
+	firstByte              time.Time
+	serverIP               string
+}
+
+func (c *harCapture) trace() *httptrace.ClientTrace {
+	now := func(t *time.Time) {
+		c.mu.Lock()
+		*t = time.Now()
+		c.mu.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { now(&c.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { now(&c.dnsDone) },
+		ConnectStart:      func(string, string) { now(&c.connectStart) },
+		ConnectDone:       func(string, string, error) { now(&c.connDone) },
+		TLSHandshakeStart: func() { now(&c.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { now(&c.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			now(&c.gotConn)
+			c.mu.Lock()
+			c.serverIP = hostOnly(info.Conn.RemoteAddr().String())
+			c.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { now(&c.wroteRequest) },
+		GotFirstResponseByte: func() { now(&c.firstByte) },
+	}
+}
+
+// Response wraps response body, body must be read through returned reader
+func (c *harCapture) Response(resp *http.Response) io.Reader {
+	c.resp = &http.Response{
+		StatusCode: resp.StatusCode,
+		Proto:      resp.Proto,
+		Header:     resp.Header.Clone(),
+	}
+	return io.TeeReader(resp.Body, &c.respBody)
+}
+
+// Fail records upstream error
+func (c *harCapture) Fail(err error) {
+	c.err = err
+}
+
+// Done builds har entry and adds to recorder
+func (c *harCapture) Done() {
+	end := time.Now()
+	r := c.Request
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := harEntry{
+		StartedDateTime: c.start,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         r.URL.String(),
+			HTTPVersion: r.Proto,
+			Cookies:     harCookies(r.Cookies()),
+			Headers:     harHeaders(r.Header),
+			QueryString: harQuery(r),
+			HeadersSize: -1,
+			BodySize:    c.reqBody.n,
+		},
+		Timings: harTimings{
+			DNS:     msBetween(c.dnsStart, c.dnsDone),
+			Connect: msBetween(c.connectStart, latest(c.connDone, c.tlsDone)),
+			SSL:     msBetween(c.tlsStart, c.tlsDone),
+			// har allows -1 only for blocked, dns, connect and ssl
+			Send:    nonNegative(msBetween(c.gotConn, c.wroteRequest)),
+			Wait:    nonNegative(msBetween(c.wroteRequest, c.firstByte)),
+			Receive: nonNegative(msBetween(c.firstByte, end)),
+		},
+		ServerIPAddress: c.serverIP,
+		User:            userFromContext(r.Context()),
+	}
+	if c.reqBody.n > 0 {
+		entry.Request.BodyHash = hex.EncodeToString(c.reqHash.Sum(nil))
+
+		text, encoding := c.reqBody.text()
+		entry.Request.PostData = &harPostData{
+			MimeType: r.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+			Comment:  c.reqBody.comment(),
+		}
+	}
+
+	// blocked is time waiting for connection, excluding dns and connect
+	entry.Timings.Blocked = msBetween(c.start, c.gotConn)
+	if entry.Timings.Blocked >= 0 {
+		entry.Timings.Blocked -= nonNegative(entry.Timings.DNS) + nonNegative(entry.Timings.Connect)
+		if entry.Timings.Blocked < 0 {
+			entry.Timings.Blocked = 0
+		}
+	}
+	t := entry.Timings
+	entry.Time = nonNegative(t.Blocked) + nonNegative(t.DNS) + nonNegative(t.Connect) +
+		nonNegative(t.Send) + nonNegative(t.Wait) + nonNegative(t.Receive)
+
+	if resp := c.resp; resp != nil {
+		text, encoding := c.respBody.text()
+		entry.Response = harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     harCookies(resp.Cookies()),
+			Headers:     harHeaders(resp.Header),
+			Content: harContent{
+				Size:     c.respBody.n,
+				MimeType: resp.Header.Get("Content-Type"),
+				Text:     text,
+				Encoding: encoding,
+				Comment:  c.respBody.comment(),
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    c.respBody.n,
+		}
+	} else {
+		entry.Response = harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	}
+	if c.err != nil {
+		entry.Comment = c.err.Error()
+	}
+
+	c.rec.add(entry)
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	xs := []harNameValue{}
+	for k, vs := range h {
+		for _, v := range vs {
+			xs = append(xs, harNameValue{k, v})
+		}
+	}
+	return xs
+}
+
+func harCookies(cs []*http.Cookie) []harNameValue {
+	xs := []harNameValue{}
+	for _, c := range cs {
+		xs = append(xs, harNameValue{c.Name, c.Value})
+	}
+	return xs
+}
+
+func harQuery(r *http.Request) []harNameValue {
+	xs := []harNameValue{}
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			xs = append(xs, harNameValue{k, v})
+		}
+	}
+	return xs
+}
+
+func msBetween(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() {
+		return -1
+	}
+	return float64(end.Sub(start)) / float64(time.Millisecond)
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func nonNegative(x float64) float64 {
+	if x < 0 {
+		return 0
+	}
+	return x
+}
+
+// limitedBuffer keeps the first limit bytes, and counts all bytes written
+type limitedBuffer struct {
+	limit int64
+	buf   []byte
+	n     int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	if rest := b.limit - int64(len(b.buf)); rest > 0 {
+		if int64(len(p)) > rest {
+			b.buf = append(b.buf, p[:rest]...)
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// text returns buffer as har text, binary content is base64 encoded
+func (b *limitedBuffer) text() (text string, encoding string) {
+	if utf8.Valid(b.buf) {
+		return string(b.buf), ""
+	}
+	return base64.StdEncoding.EncodeToString(b.buf), "base64"
+}
+
+func (b *limitedBuffer) comment() string {
+	if b.n > int64(len(b.buf)) {
+		return "truncated"
+	}
+	return ""
+}
+
+// lockedWriter holds mu while writing to w
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (lw lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
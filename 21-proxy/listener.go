@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// forwardConnListener is an in-memory listener,
+// proxy handlers hand off client connections to be served by tls server
+type forwardConnListener struct {
+	addr   net.Addr
+	ch     chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newForwardConnListener(addr net.Addr, backlog int) *forwardConnListener {
+	return &forwardConnListener{
+		addr:   addr,
+		ch:     make(chan net.Conn, backlog),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *forwardConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Forward hands off conn to the listener, blocks until accepted into backlog,
+// ctx done or listener closed, caller still owns conn on error
+func (l *forwardConnListener) Forward(ctx context.Context, conn net.Conn) error {
+	select {
+	case <-l.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case l.ch <- conn:
+	case <-l.closed:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// listener may close while sending, nobody will accept it
+	select {
+	case <-l.closed:
+		l.drain()
+	default:
+	}
+	return nil
+}
+
+// Close stops accepting, and closes connections waiting in backlog
+func (l *forwardConnListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.closed)
+		err = nil
+	})
+	l.drain()
+	return err
+}
+
+func (l *forwardConnListener) drain() {
+	for {
+		select {
+		case conn := <-l.ch:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (l *forwardConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// forwardAddr is the address of forwardConnListener
+type forwardAddr string
+
+func (a forwardAddr) Network() string { return "forward" }
+func (a forwardAddr) String() string  { return string(a) }
+
+// connOrigin describes where an intercepted connection came from
+type connOrigin struct {
+	Via        string // connect or socks
+	Target     string // requested target, host:port
+	ClientAddr string
+	User       string // authenticated user, empty if auth disabled
+}
+
+// tunneledConn is a client connection handed off to forwardConnListener
+type tunneledConn struct {
+	net.Conn
+	origin connOrigin
+}
+
+var originContextKey = &contextKey{"origin"}
+
+// originFromContext returns origin of intercepted connection, nil if not intercepted
+func originFromContext(ctx context.Context) *connOrigin {
+	origin, _ := ctx.Value(originContextKey).(*connOrigin)
+	return origin
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConn records Close, other methods are not used by forwardConnListener
+type testConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *testConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *testConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+func TestForwardConnListenerAcceptAfterClose(t *testing.T) {
+	l := newForwardConnListener(forwardAddr("test"), 1)
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	conn, err := l.Accept()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept after close: got %v, want net.ErrClosed", err)
+	}
+	if conn != nil {
+		t.Fatalf("accept after close: got conn")
+	}
+
+	if err := l.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("second close: got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestForwardConnListenerAcceptUnblocksOnClose(t *testing.T) {
+	l := newForwardConnListener(forwardAddr("test"), 1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("accept: got %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept still blocked after close")
+	}
+}
+
+func TestForwardConnListenerForwardAfterClose(t *testing.T) {
+	l := newForwardConnListener(forwardAddr("test"), 1)
+	l.Close()
+
+	conn := &testConn{}
+	err := l.Forward(context.Background(), conn)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("forward after close: got %v, want net.ErrClosed", err)
+	}
+	if conn.isClosed() {
+		t.Fatal("forward after close closed conn, caller still owns it")
+	}
+}
+
+func TestForwardConnListenerCloseDrainsBacklog(t *testing.T) {
+	l := newForwardConnListener(forwardAddr("test"), 2)
+
+	conns := []*testConn{{}, {}}
+	for _, conn := range conns {
+		if err := l.Forward(context.Background(), conn); err != nil {
+			t.Fatalf("forward: %v", err)
+		}
+	}
+
+	l.Close()
+
+	for i, conn := range conns {
+		if !conn.isClosed() {
+			t.Errorf("conn %d in backlog not closed", i)
+		}
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept after drain: got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestForwardConnListenerForwardTimeout(t *testing.T) {
+	l := newForwardConnListener(forwardAddr("test"), 1)
+	defer l.Close()
+
+	if err := l.Forward(context.Background(), &testConn{}); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+
+	// backlog is full, nobody accepts
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	conn := &testConn{}
+	start := time.Now()
+	err := l.Forward(ctx, conn)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("forward on full backlog: got %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("forward returned after %v, want about ctx timeout", d)
+	}
+	if conn.isClosed() {
+		t.Fatal("forward timeout closed conn, caller still owns it")
+	}
+}
@@ -1,164 +1,501 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"io"
-	"io/ioutil"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 func main() {
-	{
-		caKeyBytes, _ := ioutil.ReadFile("ca.key")
-		caKeyPem, _ := pem.Decode(caKeyBytes)
-		caPriv, err := x509.ParseECPrivateKey(caKeyPem.Bytes)
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		runCA(os.Args[2:])
+		return
+	}
+
+	caCrt, caPriv, err := loadCA(caCertFile, caKeyFile)
+	if err != nil {
+		log.Fatalf("load ca: %v, run \"%s ca init\" to generate one", err, os.Args[0])
+	}
+
+	issuer, err := newCertIssuer(caCrt, caPriv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certs := newCertCache(certCacheSize, certCacheDir, caCrt, issuer.Issue)
+
+	mitmListener = newForwardConnListener(forwardAddr(proxyAddr), mitmBacklog)
+	mitmSrv := &http.Server{
+		Handler:           http.HandlerFunc(proxyHTTPS),
+		ReadHeaderTimeout: mitmHandshakeTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			if c, ok := c.(*tunneledConn); ok {
+				ctx = context.WithValue(ctx, originContextKey, &c.origin)
+				if c.origin.User != "" {
+					ctx = context.WithValue(ctx, userContextKey, c.origin.User)
+				}
+			}
+			return ctx
+		},
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS10,
+			CurvePreferences: []tls.CurveID{
+				tls.X25519,
+				tls.CurveP256,
+			},
+			PreferServerCipherSuites: true,
+			GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return certs.Get(clientHelloHost(info))
+			},
+		},
+	}
+	err = http2.ConfigureServer(mitmSrv, &http2.Server{
+		MaxConcurrentStreams: http2MaxConcurrentStreams,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// negotiate only http/1.1 with client for http1Hosts
+	http1Config := mitmSrv.TLSConfig.Clone()
+	http1Config.NextProtos = []string{"http/1.1"}
+	mitmSrv.TLSConfig.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		if useHTTP1(clientHelloHost(info)) {
+			return http1Config, nil
+		}
+		return nil, nil
+	}
+
+	go func() {
+		err := mitmSrv.ServeTLS(mitmListener, "", "")
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	if htpasswdPath != "" {
+		users, err = newHtpasswd(htpasswdPath, proxyACLs)
 		if err != nil {
 			log.Fatal(err)
 		}
-		caCrtBytes, _ := ioutil.ReadFile("ca.crt")
-		caCrtPem, _ := pem.Decode(caCrtBytes)
-		caCrt, err := x509.ParseCertificate(caCrtPem.Bytes)
+		reloadOnSignal("htpasswd", users.Reload)
+	}
+
+	if harDir != "" {
+		recorder, err = newHARRecorder(harDir, harHosts)
 		if err != nil {
 			log.Fatal(err)
 		}
+	}
 
-		var cacheCrt = make(map[string]*tls.Certificate)
-
-		srv := &http.Server{
-			Handler: http.HandlerFunc(proxyHTTPS),
-			TLSConfig: &tls.Config{
-				MinVersion: tls.VersionTLS10,
-				CurvePreferences: []tls.CurveID{
-					tls.X25519,
-					tls.CurveP256,
-				},
-				PreferServerCipherSuites: true,
-				GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-					if _, ok := cacheCrt[info.ServerName]; ok {
-						return cacheCrt[info.ServerName], nil
-					}
-					log.Println("generate cert", info.ServerName)
-
-					privKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-
-					serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-					x509Crt := &x509.Certificate{
-						Subject: pkix.Name{
-							CommonName: info.ServerName,
-						},
-						Issuer:       caCrt.Issuer,
-						SerialNumber: serial,
-						NotBefore:    time.Now().UTC(),
-						NotAfter:     time.Now().UTC().AddDate(1, 0, 0).UTC(),
-						KeyUsage:     x509.KeyUsageDigitalSignature,
-						DNSNames:     []string{info.ServerName},
-						ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-					}
-					crt, err := x509.CreateCertificate(rand.Reader, x509Crt, caCrt, &privKey.PublicKey, caPriv)
-					if err != nil {
-						return nil, err
-					}
-
-					cacheCrt[info.ServerName] = &tls.Certificate{
-						Certificate: [][]byte{crt},
-						PrivateKey:  privKey,
-						Leaf:        x509Crt,
-					}
-
-					return cacheCrt[info.ServerName], nil
-				},
-			},
+	if replayPath != "" {
+		replay, err = newReplayer(replayPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if replay.miss == replayMissRecord && recorder == nil {
+			log.Fatal("replay: record on miss requires harDir")
+		}
+	}
+
+	if rewritePath != "" {
+		rewrites, err = newRewriter(rewritePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloadOnSignal("rewrite", rewrites.Reload)
+	}
+
+	if socksAddr != "" {
+		ln, err := net.Listen("tcp", socksAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
-		go srv.ServeTLS(&forwardConnListener{}, "", "")
+		go serveSOCKS(ln)
 	}
 
-	http.ListenAndServe(":8888", http.HandlerFunc(proxy))
+	err = shaping.Set(shapeConfig{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	local := http.NewServeMux()
+	local.Handle("/", caHandler(caCrt))
+	local.Handle("/admin/shape", shapeAdminHandler())
+	proxySrv := &http.Server{
+		Addr: proxyAddr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isLocalRequest(r) {
+				local.ServeHTTP(w, r)
+				return
+			}
+			proxy(w, r)
+		}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		proxySrv.Shutdown(ctx)
+		mitmSrv.Shutdown(ctx)
+		if recorder != nil {
+			recorder.Close()
+		}
+	}()
+
+	err = proxySrv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
 
-var tr = &http.Transport{}
+var (
+	proxyAddr            = ":8888"
+	mitmBacklog          = 128
+	mitmForwardTimeout   = 10 * time.Second // give up if tls server can not accept in time
+	mitmHandshakeTimeout = 30 * time.Second
+	shutdownTimeout      = 10 * time.Second
+)
+
+// clientHelloHost returns sni, or CONNECT target for client connect to ip address without sni
+func clientHelloHost(info *tls.ClientHelloInfo) string {
+	host := info.ServerName
+	if c, ok := info.Conn.(*tunneledConn); ok && host == "" {
+		host, _, _ = net.SplitHostPort(c.origin.Target)
+	}
+	return host
+}
+
+// mitmListener hands off connections to be intercepted to the tls server
+var mitmListener *forwardConnListener
+
+var (
+	certCacheSize = 1000
+	certCacheDir  = "" // ex. "certs", empty to keep generated certificates only in memory
+)
+
+var tr = &http.Transport{
+	DialContext:       dialUpstream,
+	ForceAttemptHTTP2: true,
+}
+
+// tr1 is for hosts forced to http/1.1
+var tr1 = &http.Transport{
+	DialContext:  dialUpstream,
+	TLSNextProto: make(map[string]func(string, *tls.Conn) http.RoundTripper),
+}
+
+// http1Hosts are host patterns that never use http/2, with client nor upstream
+var http1Hosts = mustCompileHostPatterns(
+// "legacy.example.com",
+)
+
+var http2MaxConcurrentStreams uint32 = 250
+
+func transportFor(target string) *http.Transport {
+	if useHTTP1(target) {
+		return tr1
+	}
+	return tr
+}
+
+func useHTTP1(target string) bool {
+	host := hostOnly(target)
+	for _, match := range http1Hosts {
+		if match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// users authenticates proxy clients, nil if auth disabled
+var users *htpasswd
+
+// recorder records proxied traffic, nil if disabled
+var recorder *harRecorder
+
+// replay serves recorded responses instead of upstream, nil if disabled
+var replay *replayer
+
+// rewrites modifies requests and responses, nil if disabled
+var rewrites *rewriter
+
+// reloadOnSignal calls reload when receive SIGHUP
+func reloadOnSignal(name string, reload func() error) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			err := reload()
+			if err != nil {
+				log.Printf("reload %s: %v", name, err)
+				continue
+			}
+			log.Printf("reload %s", name)
+		}
+	}()
+}
 
 func proxy(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Host, r.RequestURI)
+	if users != nil {
+		user, ok := proxyAuth(w, r)
+		if !ok {
+			return
+		}
+		if !users.Allow(user, r.Host) {
+			log.Println(user, "denied", r.Host)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	}
+
+	logRequest(r)
+
+	if interceptActionFor(r.Host) == actionReject {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	profile := shaping.ProfileFor(r.RemoteAddr, r.Host)
+	if profile.Drop() {
+		dropConn(w)
+		return
+	}
 
 	if r.Method == http.MethodConnect {
+		r = r.WithContext(context.WithValue(r.Context(), shapeContextKey, profile))
 		tunnelConn(w, r)
 		return
 	}
 
+	if profile != nil {
+		w, r = shapeHTTP(w, r, profile)
+	}
 	proxyHTTP(w, r)
 }
 
-var connCh = make(chan net.Conn)
+func logRequest(r *http.Request) {
+	if user := userFromContext(r.Context()); user != "" {
+		log.Println(user, r.Host, r.RequestURI)
+		return
+	}
+	log.Println(r.Host, r.RequestURI)
+}
 
-type forwardConnListener struct{}
+func tunnelConn(w http.ResponseWriter, r *http.Request) {
+	if interceptActionFor(r.Host) == actionTunnel {
+		blindTunnel(w, r)
+		return
+	}
 
-func (l *forwardConnListener) Accept() (net.Conn, error) {
-	return <-connCh, nil
+	srcConn, wr, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	wr.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+	wr.Flush()
+
+	forwardConn(&tunneledConn{
+		Conn: shapeConn(srcConn, wr.Reader, profileFromContext(r.Context())),
+		origin: connOrigin{
+			Via:        "connect",
+			Target:     r.Host,
+			ClientAddr: r.RemoteAddr,
+			User:       userFromContext(r.Context()),
+		},
+	})
 }
 
-func (l *forwardConnListener) Close() error   { return nil }
-func (l *forwardConnListener) Addr() net.Addr { return nil }
+// forwardConn hands off conn to mitmListener, closes conn if tls server does not accept in time
+func forwardConn(conn *tunneledConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), mitmForwardTimeout)
+	defer cancel()
 
-func tunnelConn(w http.ResponseWriter, r *http.Request) {
-	// dstConn, err := net.Dial("tcp", "127.0.0.1:8889")
-	// if err != nil {
-	// 	http.Error(w, "Bad Gateway", http.StatusBadGateway)
-	// 	return
-	// }
-	// defer dstConn.Close()
+	err := mitmListener.Forward(ctx, conn)
+	if err != nil {
+		log.Println("forward", conn.origin.Target, err)
+		conn.Close()
+	}
+}
 
-	srcConn, wr, _ := w.(http.Hijacker).Hijack()
-	// defer srcConn.Close()
+// blindTunnel copies bytes between client and upstream without decrypt
+func blindTunnel(w http.ResponseWriter, r *http.Request) {
+	dstConn, err := dialUpstream(r.Context(), "tcp", r.Host)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer dstConn.Close()
+
+	srcConn, wr, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer srcConn.Close()
 
 	wr.WriteString("HTTP/1.1 200 OK\r\n\r\n")
 	wr.Flush()
 
-	connCh <- srcConn
-	// go io.Copy(dstConn, srcConn)
-	// io.Copy(srcConn, dstConn)
+	// client may already send data into buffer
+	client := shapeConn(srcConn, wr.Reader, profileFromContext(r.Context()))
+	pipeConn(client, client, dstConn)
+}
+
+// pipeConn copies data between client and upstream until both sides are done
+func pipeConn(client net.Conn, clientReader io.Reader, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, clientReader)
+		closeWrite(upstream)
+		close(done)
+	}()
+	io.Copy(client, upstream)
+	closeWrite(client)
+	<-done
+}
+
+// closeWrite half-closes tcp connection, so peer see eof but can still send
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
 }
 
 func proxyHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Header.Del("Accept-Encoding")
 
-	// if r.Body != nil {
-	// 	b := r.Body
-	// 	defer b.Close()
-	// 	r.Body = ioutil.NopCloser(io.TeeReader(r.Body, os.Stdout))
-	// }
+	var rules []*rewriteRule
+	if rewrites != nil {
+		rules = rewrites.Match(r)
+		responded, err := applyRequestRules(w, r, rules)
+		if err != nil {
+			rewriteFailed(w, err)
+			return
+		}
+		if responded {
+			return
+		}
+	}
+
+	record := recorder != nil
+	if replay != nil {
+		if replay.Serve(w, r) {
+			return
+		}
+
+		switch replay.miss {
+		case replayMissFail:
+			log.Println("replay: miss", r.Method, r.URL)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		case replayMissPass:
+			record = false
+		}
+	}
+
+	var capture *harCapture
+	if record && recorder.Match(r.URL.Host) {
+		capture = recorder.Capture(r)
+		r = capture.Request
+		defer capture.Done()
+	}
 
-	resp, err := tr.RoundTrip(r)
+	resp, err := transportFor(r.URL.Host).RoundTrip(r)
 	if err != nil {
 		log.Println(err)
+		if capture != nil {
+			capture.Fail(err)
+		}
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	var body io.Reader = resp.Body
+	if capture != nil {
+		body = capture.Response(resp)
+	}
+	if len(rules) > 0 {
+		body, err = applyResponseRules(resp, body, rules)
+		if err != nil {
+			rewriteFailed(w, err)
+			return
+		}
+	}
+
 	for k, v := range resp.Header {
+		if hopHeaders[k] && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
 		w.Header()[k] = v
 	}
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
 	w.WriteHeader(resp.StatusCode)
-	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
-		io.Copy(w, io.TeeReader(resp.Body, os.Stdout))
-	} else {
-		io.Copy(w, resp.Body)
+	io.Copy(w, body)
+
+	// trailers available after body read
+	for k, v := range resp.Trailer {
+		w.Header()[k] = v
 	}
 }
 
 func proxyHTTPS(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+
 	r.URL.Scheme = "https"
 	r.URL.Host = r.Host
+	origin := originFromContext(r.Context())
+	if r.URL.Host == "" && origin != nil {
+		// http/1.0 client without Host header
+		r.URL.Host = origin.Target
+	}
+
+	// tunnel was authorized for its target only, do not let Host header
+	// reach another host or port through it
+	if origin != nil && hostPort(r.URL.Host, "443") != hostPort(origin.Target, "443") {
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
+	if user := userFromContext(r.Context()); users != nil && !users.Allow(user, r.URL.Host) {
+		log.Println(user, "denied", r.URL.Host)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// rules were checked against tunnel target, Host header may name another host
+	if interceptActionFor(r.URL.Host) == actionReject {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	proxyHTTP(w, r)
 }
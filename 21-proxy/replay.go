@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type replayMissAction int
+
+const (
+	replayMissFail   replayMissAction = iota // respond 502
+	replayMissPass                           // forward to upstream
+	replayMissRecord                         // forward to upstream and record into harDir
+)
+
+var (
+	replayPath      = ""         // har file or directory of har files, empty to disable replay
+	replayHeaders   = []string{} // request headers that must also match, ex. Authorization
+	replayMatchBody = true       // request body must match
+	replayMiss      = replayMissFail
+)
+
+// replayer serves recorded responses, same requests are served in recorded order,
+// the last response repeats after all are served
+type replayer struct {
+	headers   []string
+	matchBody bool
+	miss      replayMissAction
+
+	mu      sync.Mutex
+	entries map[string][]*harEntry
+	served  map[string]int
+}
+
+func newReplayer(path string) (*replayer, error) {
+	rp := &replayer{
+		headers:   replayHeaders,
+		matchBody: replayMatchBody,
+		miss:      replayMiss,
+		entries:   make(map[string][]*harEntry),
+		served:    make(map[string]int),
+	}
+
+	files := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.har"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+
+	for _, fn := range files {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		var h har
+		err = json.Unmarshal(b, &h)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		for i := range h.Log.Entries {
+			entry := &h.Log.Entries[i]
+			if entry.Response.Status == 0 {
+				// upstream error, nothing to replay
+				continue
+			}
+			if entry.Response.Content.Comment == "truncated" {
+				// partial body would be served as complete, let it miss
+				log.Printf("replay: %s %s: recorded body truncated, not replayed",
+					entry.Request.Method, entry.Request.URL)
+				continue
+			}
+			key := rp.entryKey(entry)
+			rp.entries[key] = append(rp.entries[key], entry)
+		}
+	}
+
+	return rp, nil
+}
+
+func (rp *replayer) entryKey(entry *harEntry) string {
+	h := make(http.Header)
+	for _, x := range entry.Request.Headers {
+		h.Add(x.Name, x.Value)
+	}
+
+	bodyHash := entry.Request.BodyHash
+	if bodyHash == "" && entry.Request.PostData != nil {
+		body := []byte(entry.Request.PostData.Text)
+		if entry.Request.PostData.Encoding == "base64" {
+			body, _ = base64.StdEncoding.DecodeString(entry.Request.PostData.Text)
+		}
+		bodyHash = hashBody(body)
+	}
+
+	return rp.key(entry.Request.Method, entry.Request.URL, h, bodyHash)
+}
+
+func (rp *replayer) key(method, url string, h http.Header, bodyHash string) string {
+	var b strings.Builder
+	b.WriteString(method)
+	b.WriteString(" ")
+	b.WriteString(url)
+	for _, k := range rp.headers {
+		b.WriteString("\n")
+		b.WriteString(strings.Join(h.Values(k), ","))
+	}
+	if rp.matchBody {
+		b.WriteString("\n")
+		b.WriteString(bodyHash)
+	}
+	return b.String()
+}
+
+// Serve writes recorded response, returns false on miss
+func (rp *replayer) Serve(w http.ResponseWriter, r *http.Request) bool {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return true
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	key := rp.key(r.Method, r.URL.String(), r.Header, hashBody(body))
+
+	rp.mu.Lock()
+	entries := rp.entries[key]
+	i := rp.served[key]
+	if i < len(entries)-1 {
+		rp.served[key] = i + 1
+	}
+	rp.mu.Unlock()
+
+	if len(entries) == 0 {
+		return false
+	}
+	resp := entries[i].Response
+
+	for _, x := range resp.Headers {
+		if hopHeaders[http.CanonicalHeaderKey(x.Name)] {
+			continue
+		}
+		w.Header().Add(x.Name, x.Value)
+	}
+	// let server set length from the written body
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Replay", "1")
+	w.WriteHeader(resp.Status)
+
+	if resp.Content.Encoding == "base64" {
+		b, _ := base64.StdEncoding.DecodeString(resp.Content.Text)
+		w.Write(b)
+	} else {
+		w.Write([]byte(resp.Content.Text))
+	}
+	return true
+}
+
+// hopHeaders are per connection, must not forward or replay to client
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+func hashBody(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var rewritePath = "" // ex. "rewrite.json", empty to disable rewriting
+
+// rewriteRule is a rule from rewrite file,
+//
+//	[
+//	  {
+//	    "match": {"host": "api.example.com", "path": "/v1/*", "method": "GET,HEAD"},
+//	    "request": {"setHeaders": {"X-Debug": "1"}, "removeHeaders": ["Cookie"]},
+//	    "response": {"json": [{"path": "data.items.0.price", "value": 0}]}
+//	  },
+//	  {
+//	    "match": {"host": "*.ads.example"},
+//	    "respond": {"status": 204}
+//	  }
+//	]
+type rewriteRule struct {
+	Match    rewriteMatch     `json:"match"`
+	Request  *rewriteMessage  `json:"request"`
+	Respond  *rewriteRespond  `json:"respond"`
+	Response *rewriteResponse `json:"response"`
+
+	host func(string) bool
+	path func(string) bool
+}
+
+// rewriteMatch matches request, empty field matches all
+type rewriteMatch struct {
+	Host   string `json:"host"`   // host pattern, see hostRule
+	Path   string `json:"path"`   // glob, or regexp prefix with ~
+	Method string `json:"method"` // comma separated methods
+}
+
+// rewriteMessage modifies request or response
+type rewriteMessage struct {
+	URL           string            `json:"url"` // request only, replace request url
+	SetHeaders    map[string]string `json:"setHeaders"`
+	RemoveHeaders []string          `json:"removeHeaders"`
+	Body          *string           `json:"body"` // replace whole body
+	Replace       []rewriteReplace  `json:"replace"`
+	JSON          []rewriteJSON     `json:"json"`
+
+	url *url.URL
+}
+
+type rewriteResponse struct {
+	rewriteMessage
+	Status int `json:"status"`
+}
+
+// rewriteRespond responds without sending request to upstream
+type rewriteRespond struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// rewriteReplace replaces all regexp matches in body, With can use $1 for submatch
+type rewriteReplace struct {
+	Regex string `json:"regex"`
+	With  string `json:"with"`
+
+	re *regexp.Regexp
+}
+
+// rewriteJSON sets value at dot separated path, ex. data.items.0.name
+type rewriteJSON struct {
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// rewriter holds rules loaded from file
+type rewriter struct {
+	filename string
+
+	mu    sync.RWMutex
+	rules []*rewriteRule
+}
+
+func newRewriter(filename string) (*rewriter, error) {
+	rw := &rewriter{filename: filename}
+	err := rw.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Reload reloads rules from file, keeps current rules on error
+func (rw *rewriter) Reload() error {
+	b, err := ioutil.ReadFile(rw.filename)
+	if err != nil {
+		return err
+	}
+
+	var rules []*rewriteRule
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return fmt.Errorf("%s: %v", rw.filename, err)
+	}
+	for i, rule := range rules {
+		err = rule.compile()
+		if err != nil {
+			return fmt.Errorf("%s: rule %d: %v", rw.filename, i, err)
+		}
+	}
+
+	rw.mu.Lock()
+	rw.rules = rules
+	rw.mu.Unlock()
+	return nil
+}
+
+// Match returns rules matched request, in file order
+func (rw *rewriter) Match(r *http.Request) []*rewriteRule {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+
+	var rs []*rewriteRule
+	for _, rule := range rw.rules {
+		if rule.match(r) {
+			rs = append(rs, rule)
+		}
+	}
+	return rs
+}
+
+func (rule *rewriteRule) compile() error {
+	var err error
+	if rule.Match.Host != "" {
+		rule.host, err = compileHostPattern(rule.Match.Host)
+		if err != nil {
+			return err
+		}
+	}
+	if p := rule.Match.Path; p != "" {
+		if strings.HasPrefix(p, "~") {
+			re, err := regexp.Compile(p[1:])
+			if err != nil {
+				return err
+			}
+			rule.path = re.MatchString
+		} else {
+			if _, err := path.Match(p, ""); err != nil {
+				return err
+			}
+			rule.path = func(s string) bool {
+				ok, _ := path.Match(p, s)
+				return ok
+			}
+		}
+	}
+	if rule.Request != nil {
+		err = rule.Request.compile()
+		if err != nil {
+			return err
+		}
+		if rule.Request.URL != "" {
+			rule.Request.url, err = url.Parse(rule.Request.URL)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if rule.Response != nil {
+		err = rule.Response.compile()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *rewriteMessage) compile() error {
+	for i := range m.Replace {
+		re, err := regexp.Compile(m.Replace[i].Regex)
+		if err != nil {
+			return err
+		}
+		m.Replace[i].re = re
+	}
+	return nil
+}
+
+func (rule *rewriteRule) match(r *http.Request) bool {
+	if rule.host != nil && !rule.host(hostOnly(r.URL.Host)) {
+		return false
+	}
+	if rule.path != nil && !rule.path(r.URL.Path) {
+		return false
+	}
+	if rule.Match.Method != "" {
+		found := false
+		for _, m := range splitList(rule.Match.Method) {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRequestRules applies request rules, returns true if a rule responded
+func applyRequestRules(w http.ResponseWriter, r *http.Request, rules []*rewriteRule) (bool, error) {
+	for _, rule := range rules {
+		if m := rule.Request; m != nil {
+			if m.url != nil {
+				*r.URL = *m.url
+				r.Host = m.url.Host
+			}
+			applyHeaders(r.Header, m)
+
+			if m.hasBody() {
+				var body []byte
+				if r.Body != nil {
+					var err error
+					body, err = ioutil.ReadAll(r.Body)
+					r.Body.Close()
+					if err != nil {
+						return false, err
+					}
+				}
+				body, err := m.rewriteBody(body)
+				if err != nil {
+					return false, err
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				r.ContentLength = int64(len(body))
+				r.Header.Del("Content-Length")
+				r.TransferEncoding = nil
+			}
+		}
+
+		if rs := rule.Respond; rs != nil {
+			for k, v := range rs.Headers {
+				w.Header().Set(k, v)
+			}
+			status := rs.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(rs.Body)))
+			w.WriteHeader(status)
+			io.WriteString(w, rs.Body)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// applyResponseRules applies response rules, returns reader for the new body
+func applyResponseRules(resp *http.Response, body io.Reader, rules []*rewriteRule) (io.Reader, error) {
+	var b []byte
+	buffered := false
+
+	for _, rule := range rules {
+		m := rule.Response
+		if m == nil {
+			continue
+		}
+		if m.Status != 0 {
+			resp.StatusCode = m.Status
+		}
+		applyHeaders(resp.Header, &m.rewriteMessage)
+
+		if m.hasBody() {
+			if !buffered {
+				var err error
+				b, err = ioutil.ReadAll(body)
+				if err != nil {
+					return nil, err
+				}
+				buffered = true
+			}
+			var err error
+			b, err = m.rewriteBody(b)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !buffered {
+		return body, nil
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	resp.Header.Del("Content-Encoding")
+	return bytes.NewReader(b), nil
+}
+
+func applyHeaders(h http.Header, m *rewriteMessage) {
+	for _, k := range m.RemoveHeaders {
+		h.Del(k)
+	}
+	for k, v := range m.SetHeaders {
+		h.Set(k, v)
+	}
+}
+
+func (m *rewriteMessage) hasBody() bool {
+	return m.Body != nil || len(m.Replace) > 0 || len(m.JSON) > 0
+}
+
+func (m *rewriteMessage) rewriteBody(b []byte) ([]byte, error) {
+	if m.Body != nil {
+		b = []byte(*m.Body)
+	}
+	for _, x := range m.Replace {
+		b = x.re.ReplaceAll(b, []byte(x.With))
+	}
+	if len(m.JSON) > 0 {
+		v, err := decodeJSON(b)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite json: %v", err)
+		}
+		for _, x := range m.JSON {
+			// rule is shared by requests, later paths may write into inserted value
+			v, err = setJSONPath(v, strings.Split(x.Path, "."), copyJSON(x.Value))
+			if err != nil {
+				return nil, fmt.Errorf("rewrite json %s: %v", x.Path, err)
+			}
+		}
+		b, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// decodeJSON decodes single json value, numbers are kept as json.Number
+// so large integers are not rounded through float64
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level value")
+	}
+	return v, nil
+}
+
+// copyJSON returns deep copy of decoded json
+func copyJSON(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			c[k] = copyJSON(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(x))
+		for i, e := range x {
+			c[i] = copyJSON(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// setJSONPath sets value into decoded json at path, returns the modified root
+func setJSONPath(v interface{}, keys []string, value interface{}) (interface{}, error) {
+	if len(keys) == 0 {
+		return value, nil
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		child, err := setJSONPath(x[keys[0]], keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		x[keys[0]] = child
+		return x, nil
+	case []interface{}:
+		i, err := strconv.Atoi(keys[0])
+		if err != nil || i < 0 || i >= len(x) {
+			return nil, fmt.Errorf("invalid index %q", keys[0])
+		}
+		x[i], err = setJSONPath(x[i], keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return x, nil
+	case nil:
+		// create missing object
+		child, err := setJSONPath(nil, keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{keys[0]: child}, nil
+	default:
+		return nil, errors.New("not an object or array")
+	}
+}
+
+// rewriteFailed logs rewrite error and responds 502
+func rewriteFailed(w http.ResponseWriter, err error) {
+	log.Println("rewrite:", err)
+	http.Error(w, "Bad Gateway", http.StatusBadGateway)
+}
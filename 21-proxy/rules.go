@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type interceptAction int
+
+const (
+	actionIntercept interceptAction = iota // decrypt and inspect traffic
+	actionTunnel                           // blind tunnel, client see upstream certificate
+	actionReject                           // refuse to connect
+)
+
+func (a interceptAction) String() string {
+	switch a {
+	case actionIntercept:
+		return "intercept"
+	case actionTunnel:
+		return "tunnel"
+	case actionReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("action(%d)", int(a))
+	}
+}
+
+// hostRule matches request host with pattern, pattern can be
+//   - glob: api.example.com, *.example.com
+//   - regexp, prefix with ~: ~^api[0-9]+\.example\.com$
+//   - cidr, only match ip literal host: 10.0.0.0/8
+type hostRule struct {
+	Pattern string
+	Action  interceptAction
+}
+
+// interceptRules are evaluated in order, first match wins
+var interceptRules = mustCompileHostRules(
+	hostRule{"*.bank.example", actionTunnel},
+	hostRule{"api.example.com", actionIntercept},
+	hostRule{"*.api.example.com", actionIntercept},
+	hostRule{"127.0.0.0/8", actionIntercept},
+)
+
+// defaultInterceptAction is used when no rule match
+var defaultInterceptAction = actionTunnel
+
+type compiledHostRule struct {
+	hostRule
+	match func(host string) bool
+}
+
+func mustCompileHostRules(rules ...hostRule) []compiledHostRule {
+	rs, err := compileHostRules(rules)
+	if err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+func compileHostRules(rules []hostRule) ([]compiledHostRule, error) {
+	var rs []compiledHostRule
+	for _, rule := range rules {
+		match, err := compileHostPattern(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule.Pattern, err)
+		}
+		rs = append(rs, compiledHostRule{rule, match})
+	}
+	return rs, nil
+}
+
+func mustCompileHostPatterns(patterns ...string) []func(host string) bool {
+	var ms []func(string) bool
+	for _, p := range patterns {
+		match, err := compileHostPattern(p)
+		if err != nil {
+			panic(fmt.Sprintf("host pattern %q: %v", p, err))
+		}
+		ms = append(ms, match)
+	}
+	return ms
+}
+
+func compileHostPattern(pattern string) (func(host string) bool, error) {
+	if strings.HasPrefix(pattern, "~") {
+		re, err := regexp.Compile("(?i)" + pattern[1:])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	if strings.Contains(pattern, "/") {
+		_, n, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(host string) bool {
+			ip := net.ParseIP(host)
+			return ip != nil && n.Contains(ip)
+		}, nil
+	}
+
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(host string) bool {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	}, nil
+}
+
+// interceptActionFor returns action for target, target can be host or host:port
+func interceptActionFor(target string) interceptAction {
+	return matchHostRules(interceptRules, target, defaultInterceptAction)
+}
+
+func matchHostRules(rules []compiledHostRule, target string, def interceptAction) interceptAction {
+	host := hostOnly(target)
+	for _, rule := range rules {
+		if rule.match(host) {
+			return rule.Action
+		}
+	}
+	return def
+}
+
+// hostOnly strips port and brackets from target, and lower case it
+func hostOnly(target string) string {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// hostPort normalizes target like hostOnly, keeping port, defaultPort if missing
+func hostPort(target, defaultPort string) string {
+	port := defaultPort
+	if _, p, err := net.SplitHostPort(target); err == nil {
+		port = p
+	}
+	return net.JoinHostPort(hostOnly(target), port)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shapeProfile simulates network condition on client connection
+type shapeProfile struct {
+	DownloadKbps int     `json:"downloadKbps"` // to client, 0 for unlimited
+	UploadKbps   int     `json:"uploadKbps"`   // from client, 0 for unlimited
+	LatencyMs    int     `json:"latencyMs"`    // one-way delay, added when a burst starts
+	JitterMs     int     `json:"jitterMs"`     // random extra delay up to value
+	DropRate     float64 `json:"dropRate"`     // 0-1, drop connection when opened
+	StallRate    float64 `json:"stallRate"`    // 0-1, stall before each chunk
+	StallMs      int     `json:"stallMs"`
+}
+
+var shapePresets = map[string]shapeProfile{
+	"slow-3g": {DownloadKbps: 400, UploadKbps: 400, LatencyMs: 1000},
+	"3g":      {DownloadKbps: 1600, UploadKbps: 750, LatencyMs: 280},
+	"4g":      {DownloadKbps: 9000, UploadKbps: 9000, LatencyMs: 85},
+	"flaky-wifi": {
+		DownloadKbps: 20000,
+		UploadKbps:   10000,
+		LatencyMs:    10,
+		JitterMs:     150,
+		DropRate:     0.05,
+		StallRate:    0.02,
+		StallMs:      2000,
+	},
+	"offline": {DropRate: 1},
+}
+
+// shapeRule selects profile by client and destination, empty field matches all
+type shapeRule struct {
+	Client  string `json:"client"` // client cidr, ex. 192.168.1.20/32
+	Host    string `json:"host"`   // host pattern, see hostRule
+	Profile string `json:"profile"`
+}
+
+type shapeConfig struct {
+	Profiles map[string]shapeProfile `json:"profiles"` // custom profiles, override presets
+	Rules    []shapeRule             `json:"rules"`    // first match wins
+	Default  string                  `json:"default"`  // profile when no rule match, empty for no shaping
+}
+
+// shaping is current config, change at runtime through /admin/shape
+var shaping = &shaper{}
+
+// adminCIDRs are clients allowed to use admin endpoints
+var adminCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+type shaper struct {
+	mu       sync.RWMutex
+	config   shapeConfig
+	profiles map[string]*shapeProfile
+	rules    []compiledShapeRule
+}
+
+type compiledShapeRule struct {
+	client  *net.IPNet
+	host    func(string) bool
+	profile *shapeProfile
+}
+
+// Set validates and replaces config
+func (s *shaper) Set(config shapeConfig) error {
+	profiles := make(map[string]*shapeProfile)
+	for name, p := range shapePresets {
+		p := p
+		profiles[name] = &p
+	}
+	for name, p := range config.Profiles {
+		p := p
+		profiles[name] = &p
+	}
+
+	lookup := func(name string) (*shapeProfile, error) {
+		if name == "" {
+			return nil, nil
+		}
+		p, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		return p, nil
+	}
+
+	var rules []compiledShapeRule
+	for _, rule := range config.Rules {
+		var r compiledShapeRule
+		var err error
+		if rule.Client != "" {
+			_, r.client, err = net.ParseCIDR(rule.Client)
+			if err != nil {
+				return err
+			}
+		}
+		if rule.Host != "" {
+			r.host, err = compileHostPattern(rule.Host)
+			if err != nil {
+				return err
+			}
+		}
+		r.profile, err = lookup(rule.Profile)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	def, err := lookup(config.Default)
+	if err != nil {
+		return err
+	}
+	if def != nil {
+		rules = append(rules, compiledShapeRule{profile: def})
+	}
+
+	s.mu.Lock()
+	s.config = config
+	s.profiles = profiles
+	s.rules = rules
+	s.mu.Unlock()
+	return nil
+}
+
+// ProfileFor returns profile for client connect to target, nil for no shaping
+func (s *shaper) ProfileFor(clientAddr, target string) *shapeProfile {
+	clientIP := net.ParseIP(hostOnly(clientAddr))
+	host := hostOnly(target)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, rule := range s.rules {
+		if rule.client != nil && (clientIP == nil || !rule.client.Contains(clientIP)) {
+			continue
+		}
+		if rule.host != nil && !rule.host(host) {
+			continue
+		}
+		return rule.profile
+	}
+	return nil
+}
+
+var shapeRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	shapeRand.Lock()
+	defer shapeRand.Unlock()
+	return shapeRand.Float64() < p
+}
+
+func jitter(ms int) time.Duration {
+	if ms <= 0 {
+		return 0
+	}
+	shapeRand.Lock()
+	defer shapeRand.Unlock()
+	return time.Duration(shapeRand.Intn(ms)) * time.Millisecond
+}
+
+// Drop returns true if new connection should be dropped
+func (p *shapeProfile) Drop() bool {
+	return p != nil && chance(p.DropRate)
+}
+
+var shapeContextKey = &contextKey{"shape"}
+
+func profileFromContext(ctx context.Context) *shapeProfile {
+	p, _ := ctx.Value(shapeContextKey).(*shapeProfile)
+	return p
+}
+
+// shapeChunk is max bytes sent at once, so bandwidth is smooth
+const shapeChunk = 4 * 1024
+
+// throttle delays one direction of a stream, nil throttle does nothing
+type throttle struct {
+	p    *shapeProfile
+	kbps int
+	next time.Time // when bandwidth allow next byte
+	last time.Time // last transfer, for detect new burst
+}
+
+func newThrottle(p *shapeProfile, kbps int) *throttle {
+	if p == nil {
+		return nil
+	}
+	return &throttle{p: p, kbps: kbps}
+}
+
+// wait blocks before transfer n bytes
+func (t *throttle) wait(n int) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	latency := time.Duration(t.p.LatencyMs) * time.Millisecond
+	if latency > 0 || t.p.JitterMs > 0 {
+		if now.Sub(t.last) > latency {
+			time.Sleep(latency + jitter(t.p.JitterMs))
+			now = time.Now()
+		}
+	}
+	if chance(t.p.StallRate) {
+		time.Sleep(time.Duration(t.p.StallMs) * time.Millisecond)
+		now = time.Now()
+	}
+	if t.kbps > 0 {
+		if t.next.Before(now) {
+			t.next = now
+		}
+		t.next = t.next.Add(time.Duration(n) * 8 * time.Millisecond / time.Duration(t.kbps))
+		time.Sleep(t.next.Sub(now))
+	}
+	t.last = time.Now()
+}
+
+func (t *throttle) write(w io.Writer, p []byte) (int, error) {
+	if t == nil {
+		return w.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > shapeChunk {
+			chunk = chunk[:shapeChunk]
+		}
+		t.wait(len(chunk))
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (t *throttle) read(r io.Reader, p []byte) (int, error) {
+	if t == nil {
+		return r.Read(p)
+	}
+	if len(p) > shapeChunk {
+		p = p[:shapeChunk]
+	}
+	n, err := r.Read(p)
+	if n > 0 {
+		t.wait(n)
+	}
+	return n, err
+}
+
+// shapedConn is a client connection with shaped read and write
+type shapedConn struct {
+	net.Conn
+	r        io.Reader
+	upload   *throttle
+	download *throttle
+}
+
+// shapeConn wraps client conn, r is used for read if client data already buffered
+func shapeConn(conn net.Conn, r io.Reader, p *shapeProfile) *shapedConn {
+	if r == nil {
+		r = conn
+	}
+	c := &shapedConn{Conn: conn, r: r}
+	if p != nil {
+		c.upload = newThrottle(p, p.UploadKbps)
+		c.download = newThrottle(p, p.DownloadKbps)
+	}
+	return c
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	return c.upload.read(c.r, p)
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	return c.download.write(c.Conn, p)
+}
+
+func (c *shapedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// shapeHTTP shapes a plain http request, for connection owned by http server
+func shapeHTTP(w http.ResponseWriter, r *http.Request, p *shapeProfile) (http.ResponseWriter, *http.Request) {
+	if r.Body != nil && r.Body != http.NoBody {
+		up := newThrottle(p, p.UploadKbps)
+		body := r.Body
+		r.Body = readCloser{readerFunc(func(b []byte) (int, error) { return up.read(body, b) }), body}
+	}
+	return &shapedResponseWriter{ResponseWriter: w, download: newThrottle(p, p.DownloadKbps)}, r
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+type shapedResponseWriter struct {
+	http.ResponseWriter
+	download *throttle
+}
+
+func (w *shapedResponseWriter) Write(p []byte) (int, error) {
+	return w.download.write(w.ResponseWriter, p)
+}
+
+func (w *shapedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// dropConn closes client connection without response
+func dropConn(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// shapeAdminHandler gets or replaces shaping config,
+//
+//	curl localhost:8888/admin/shape
+//	curl -X PUT localhost:8888/admin/shape -d '{"default":"3g"}'
+func shapeAdminHandler() http.Handler {
+	allow := parseCIDRs(adminCIDRs...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only direct request, not through proxy
+		if r.URL.IsAbs() || !ipInCIDRs(net.ParseIP(hostOnly(r.RemoteAddr)), allow) {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			shaping.mu.RLock()
+			config := shaping.config
+			shaping.mu.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				shapeConfig
+				Presets map[string]shapeProfile `json:"presets"`
+			}{config, shapePresets})
+		case http.MethodPut, http.MethodPost:
+			var config shapeConfig
+			err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&config)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = shaping.Set(config)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("shape: default=%q rules=%d", config.Default, len(config.Rules))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var ns []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+func ipInCIDRs(ip net.IP, ns []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+var socksAddr = "" // ex. ":1080", empty to disable socks5 listener
+
+// SOCKS5, see RFC 1928 and RFC 1929
+const (
+	socksVersion = 0x05
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoAccept = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSuccess         = 0x00
+	socksRepFailure         = 0x01
+	socksRepNotAllowed      = 0x02
+	socksRepHostUnreachable = 0x04
+	socksRepCmdNotSupported = 0x07
+	socksRepAtypUnsupported = 0x08
+)
+
+var (
+	socksUDPIdleTimeout = 2 * time.Minute
+	socksPeekTimeout    = 2 * time.Second // wait for tls client hello on intercepted target
+)
+
+func serveSOCKS(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("socks:", err)
+			return
+		}
+		go handleSOCKS(conn)
+	}
+}
+
+func handleSOCKS(conn net.Conn) {
+	br := bufio.NewReader(conn)
+
+	// handshake must finish in time
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	user, err := socksHandshake(conn, br)
+	if err != nil {
+		log.Println("socks:", err)
+		conn.Close()
+		return
+	}
+
+	var head [3]byte
+	_, err = io.ReadFull(br, head[:])
+	if err != nil || head[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	target, err := readSocksAddr(br)
+	if err != nil {
+		if err == errSocksAtyp {
+			writeSocksReply(conn, socksRepAtypUnsupported, nil)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if user != "" {
+		log.Println(user, "socks", target)
+	} else {
+		log.Println("socks", target)
+	}
+
+	switch head[1] {
+	case socksCmdConnect:
+		if !socksAllowed(user, target) {
+			writeSocksReply(conn, socksRepNotAllowed, nil)
+			conn.Close()
+			return
+		}
+		socksConnect(conn, br, target, user)
+	case socksCmdUDPAssociate:
+		socksUDPAssociate(conn, br, user)
+	default:
+		writeSocksReply(conn, socksRepCmdNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// socksHandshake negotiates auth method, returns authenticated user
+func socksHandshake(conn net.Conn, br *bufio.Reader) (string, error) {
+	var head [2]byte
+	_, err := io.ReadFull(br, head[:])
+	if err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(br, methods)
+	if err != nil {
+		return "", err
+	}
+
+	want := byte(socksAuthNone)
+	if users != nil {
+		want = socksAuthPassword
+	}
+	found := false
+	for _, m := range methods {
+		if m == want {
+			found = true
+			break
+		}
+	}
+	if !found {
+		conn.Write([]byte{socksVersion, socksAuthNoAccept})
+		return "", errors.New("no acceptable auth method")
+	}
+	_, err = conn.Write([]byte{socksVersion, want})
+	if err != nil {
+		return "", err
+	}
+	if want == socksAuthNone {
+		return "", nil
+	}
+
+	// username/password sub-negotiation
+	var ver [1]byte
+	_, err = io.ReadFull(br, ver[:])
+	if err != nil {
+		return "", err
+	}
+	user, err := readSocksString(br)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSocksString(br)
+	if err != nil {
+		return "", err
+	}
+	if ver[0] != 0x01 || !users.Verify(user, password) {
+		conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("auth failed for %q", user)
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	if err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+func socksAllowed(user, target string) bool {
+	if users != nil && !users.Allow(user, target) {
+		return false
+	}
+	return interceptActionFor(target) != actionReject
+}
+
+func socksConnect(conn net.Conn, br *bufio.Reader, target, user string) {
+	profile := shaping.ProfileFor(conn.RemoteAddr().String(), target)
+	if profile.Drop() {
+		conn.Close()
+		return
+	}
+	client := shapeConn(conn, br, profile)
+
+	if interceptActionFor(target) == actionIntercept {
+		writeSocksReply(conn, socksRepSuccess, nil)
+
+		// only tls can be intercepted, tls record starts with handshake type 0x16,
+		// client of server-first protocol (smtp, ssh) sends nothing, tunnel it
+		conn.SetReadDeadline(time.Now().Add(socksPeekTimeout))
+		b, err := br.Peek(1)
+		conn.SetReadDeadline(time.Time{})
+		var ne net.Error
+		if err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+			conn.Close()
+			return
+		}
+		if err == nil && b[0] == 0x16 {
+			forwardConn(&tunneledConn{
+				Conn: client,
+				origin: connOrigin{
+					Via:        "socks",
+					Target:     target,
+					ClientAddr: conn.RemoteAddr().String(),
+					User:       user,
+				},
+			})
+			return
+		}
+		// fallthrough to blind tunnel, reply already sent
+		dstConn, err := dialUpstream(context.Background(), "tcp", target)
+		if err != nil {
+			log.Println("socks:", err)
+			conn.Close()
+			return
+		}
+		defer conn.Close()
+		defer dstConn.Close()
+		pipeConn(client, client, dstConn)
+		return
+	}
+
+	dstConn, err := dialUpstream(context.Background(), "tcp", target)
+	if err != nil {
+		log.Println("socks:", err)
+		writeSocksReply(conn, socksRepHostUnreachable, nil)
+		conn.Close()
+		return
+	}
+	defer conn.Close()
+	defer dstConn.Close()
+
+	writeSocksReply(conn, socksRepSuccess, dstConn.LocalAddr())
+	pipeConn(client, client, dstConn)
+}
+
+// socksUDPAssociate relays udp datagrams until control connection closed,
+// udp is always sent directly, parent proxies only carry tcp
+func socksUDPAssociate(conn net.Conn, br *bufio.Reader, user string) {
+	defer conn.Close()
+
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Println("socks:", err)
+		writeSocksReply(conn, socksRepFailure, nil)
+		return
+	}
+	defer pc.Close()
+
+	err = writeSocksReply(conn, socksRepSuccess, pc.LocalAddr())
+	if err != nil {
+		return
+	}
+
+	go func() {
+		// association ends when control connection closed
+		io.Copy(ioutil.Discard, br)
+		pc.Close()
+	}()
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	var clientAddr *net.UDPAddr
+	buf := make([]byte, 64*1024)
+	for {
+		pc.SetReadDeadline(time.Now().Add(socksUDPIdleTimeout))
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		fromClient := clientAddr == nil && from.IP.Equal(clientIP) ||
+			clientAddr != nil && from.IP.Equal(clientAddr.IP) && from.Port == clientAddr.Port
+		if fromClient {
+			// from client: RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+			if n < 4 || buf[2] != 0 {
+				// fragmentation not supported
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			target, err := readSocksAddr(r)
+			if err != nil || !socksAllowed(user, target) {
+				continue
+			}
+			dst, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				continue
+			}
+			clientAddr = from
+			pc.WriteToUDP(buf[n-r.Len():n], dst)
+			continue
+		}
+
+		// from remote, wrap with header and send to client
+		if clientAddr == nil {
+			continue
+		}
+		pkt := append([]byte{0, 0, 0}, socksAddrBytes(from)...)
+		pkt = append(pkt, buf[:n]...)
+		pc.WriteToUDP(pkt, clientAddr)
+	}
+}
+
+var errSocksAtyp = errors.New("unsupported address type")
+
+// readSocksAddr reads ATYP DST.ADDR DST.PORT as host:port
+func readSocksAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	_, err := io.ReadFull(r, atyp[:])
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4:
+		b := make([]byte, net.IPv4len)
+		_, err = io.ReadFull(r, b)
+		host = net.IP(b).String()
+	case socksAtypIPv6:
+		b := make([]byte, net.IPv6len)
+		_, err = io.ReadFull(r, b)
+		host = net.IP(b).String()
+	case socksAtypDomain:
+		host, err = readSocksString(r)
+	default:
+		return "", errSocksAtyp
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(r, port[:])
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func readSocksString(r io.Reader) (string, error) {
+	var l [1]byte
+	_, err := io.ReadFull(r, l[:])
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, l[0])
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// socksAddrBytes encodes addr as ATYP BND.ADDR BND.PORT, nil addr as 0.0.0.0:0
+func socksAddrBytes(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append([]byte{socksAtypIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksAtypIPv6}, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+func writeSocksReply(conn net.Conn, rep byte, addr net.Addr) error {
+	_, err := conn.Write(append([]byte{socksVersion, rep, 0x00}, socksAddrBytes(addr)...))
+	return err
+}